@@ -1,9 +1,11 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"os"
+	"os/signal"
 
 	"github.com/xpetit/fizzbuzz/v5"
 )
@@ -15,8 +17,17 @@ func main() {
 	flag.IntVar(&c.Int2, "int2", c.Int2, "Int2 is the second divisor")
 	flag.StringVar(&c.Str1, "str1", c.Str1, "Str1 is the string that replaces the number when it is divisible by Int1")
 	flag.StringVar(&c.Str2, "str2", c.Str2, "Str2 is the string that replaces the number when it is divisible by Int2")
+	format := fizzbuzz.JSON
+	flag.TextVar(&format, "format", format, "Format is the output format: json, ndjson, csv, text, xml, msgpack or cbor")
+	shape := fizzbuzz.Strings
+	flag.TextVar(&shape, "shape", shape, "Shape is the shape of the values in the json and ndjson formats: strings, objects or tuples")
 	flag.Parse()
-	if _, err := c.WriteTo(os.Stdout); err != nil {
+
+	// Stop writing cleanly on interruption
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	if _, err := c.EncodeContext(ctx, os.Stdout, format, shape, 1, c.Limit, nil); err != nil {
+		stop()
 		fmt.Println(err)
 		os.Exit(1)
 	}
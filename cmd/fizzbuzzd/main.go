@@ -1,18 +1,25 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"runtime"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -21,16 +28,105 @@ import (
 )
 
 type Config struct {
-	DBFile  string
-	Addr    string
+	DBFile string
+	Addr   string
+
+	// FlushInterval is the maximum delay before the stats are written to the database, 0 to write them synchronously.
+	FlushInterval time.Duration
+	// FlushSize is the number of distinct pending configs that triggers a write to the database.
+	FlushSize int
+	// StatsTimeout is the maximum duration of each call to the database, 0 to disable the circuit breaker.
+	StatsTimeout time.Duration
+	// BreakerFailures is the number of consecutive failures of the database that opens the circuit breaker.
+	BreakerFailures int
+	// BreakerCooldown is the delay before the database is tried again, once the circuit breaker is open.
+	BreakerCooldown time.Duration
+	// Retention tells how long the stats are kept for the time windows, stats.DefaultRetention if zero.
+	Retention stats.Retention
+
+	// NodeID identifies the replica among its peers, it must be unique.
+	// If empty, it is the one of the snapshot if any, random otherwise.
+	NodeID string
+	// Peers are the base URLs of the other replicas, with which the in-memory stats are synchronized.
+	Peers []string
+	// PeerSecret is the secret shared by the replicas, required to synchronize with them.
+	PeerSecret string
+	// SyncInterval is the delay between two synchronizations with the peers (5 seconds if zero), a last one being made on shutdown.
+	SyncInterval time.Duration
+
+	// SnapshotFile is the path of the file where the in-memory stats are saved, empty to disable snapshots.
+	SnapshotFile string
+	// SnapshotInterval is the delay between two snapshots (a minute if zero), a last one being saved on shutdown.
+	SnapshotInterval time.Duration
+
 	logging bool
 }
 
-func (c *Config) Run(ctx context.Context) error {
+func (c *Config) Run(ctx context.Context) (err error) {
 	// Initialize stats service
 	var statsService stats.Service
-	if c.DBFile == "off" {
-		statsService = stats.Memory()
+	if len(c.Peers) > 0 {
+		if c.DBFile != "off" {
+			return errors.New("the stats can only be synchronized with peers when they are in memory (-db off)")
+		}
+		if c.PeerSecret == "" {
+			return errors.New("the stats can only be synchronized with peers sharing a secret (-peer-secret)")
+		}
+		id := c.NodeID
+		if id == "" && c.SnapshotFile != "" {
+			// Keep the ID of the restored stats, so that the restarts don't add nodes
+			var err error
+			if id, err = stats.SnapshotNodeID(c.SnapshotFile); err != nil {
+				return fmt.Errorf("restore snapshot: %w", err)
+			}
+		}
+		if id == "" {
+			b := make([]byte, 8)
+			if _, err := rand.Read(b); err != nil {
+				return err
+			}
+			id = hex.EncodeToString(b)
+		}
+		log.Println("Using node ID:", id)
+		statsService = stats.Replicated(id)
+	} else if c.DBFile == "off" {
+		// Several shards per core, so that the concurrent requests rarely contend
+		statsService = stats.Sharded(4 * runtime.GOMAXPROCS(0))
+	} else if size, ok := strings.CutPrefix(c.DBFile, "approx:"); ok {
+		k, err := strconv.Atoi(size)
+		if err != nil || k < 1 {
+			return fmt.Errorf("invalid number of approximate stats %q: must be a strictly positive integer", size)
+		}
+		statsService = stats.Approx(k)
+	} else if dir, ok := strings.CutPrefix(c.DBFile, "journal:"); ok {
+		log.Println("Using journal directory:", dir)
+		journal, err := stats.OpenJournal(dir)
+		if err != nil {
+			return err
+		}
+		statsService = journal
+	} else if strings.HasPrefix(c.DBFile, "postgres://") || strings.HasPrefix(c.DBFile, "postgresql://") {
+		log.Println("Using PostgreSQL database:", redactURL(c.DBFile))
+		db, err := stats.OpenPostgres(ctx, c.DBFile)
+		if err != nil {
+			return err
+		}
+		statsService = db
+		if c.StatsTimeout > 0 {
+			// Keep serving when the database is unreachable, the stats being counted in memory meanwhile
+			statsService = stats.Resilient(db, c.StatsTimeout, c.BreakerFailures, c.BreakerCooldown)
+		}
+	} else if strings.HasPrefix(c.DBFile, "redis://") {
+		log.Println("Using Redis server:", redactURL(c.DBFile))
+		redis, err := stats.OpenRedis(ctx, c.DBFile)
+		if err != nil {
+			return err
+		}
+		statsService = redis
+		if c.StatsTimeout > 0 {
+			// Keep serving when the server is unreachable, the stats being counted in memory meanwhile
+			statsService = stats.Resilient(redis, c.StatsTimeout, c.BreakerFailures, c.BreakerCooldown)
+		}
 	} else {
 		if !strings.Contains(c.DBFile, ":memory:") {
 			if err := os.MkdirAll(filepath.Dir(c.DBFile), 0o700); err != nil {
@@ -42,16 +138,104 @@ func (c *Config) Run(ctx context.Context) error {
 		if err != nil {
 			return err
 		}
-		defer db.Close()
-		statsService = db
+		var backend interface {
+			stats.Service
+			stats.ContextService
+		} = db
+		if c.FlushInterval > 0 {
+			buffered := stats.Buffered(db, c.FlushInterval, c.FlushSize)
+			backend = buffered
+			// The increments don't fail, the failed flushes are reported instead
+			stop := every(time.Minute, func(time.Time) {
+				if err := buffered.Err(); err != nil {
+					log.Println("stats.flush:", err)
+				}
+			})
+			defer stop()
+		}
+		if c.StatsTimeout > 0 {
+			// Keep serving when the database is locked or failing, the stats being counted in memory meanwhile
+			backend = stats.Resilient(backend, c.StatsTimeout, c.BreakerFailures, c.BreakerCooldown)
+		}
+		statsService = backend
+	}
+	if c, ok := statsService.(io.Closer); ok {
+		defer func() {
+			if closeErr := c.Close(); err == nil {
+				err = closeErr
+			}
+		}()
+	}
+
+	// Restore the in-memory stats and save them in the background
+	stopSnapshots := func() error { return nil }
+	if c.SnapshotFile != "" {
+		s, ok := statsService.(stats.Snapshotter)
+		if !ok {
+			return errors.New("snapshots are only available with in-memory stats (-db off)")
+		}
+		log.Println("Using snapshot file:", c.SnapshotFile)
+		if err := os.MkdirAll(filepath.Dir(c.SnapshotFile), 0o700); err != nil {
+			return err
+		}
+		if err := stats.LoadSnapshot(s, c.SnapshotFile); err != nil {
+			return fmt.Errorf("restore snapshot: %w", err)
+		}
+		interval := c.SnapshotInterval
+		if interval <= 0 {
+			interval = time.Minute
+		}
+		stop := every(interval, func(time.Time) {
+			if err := stats.SaveSnapshot(s, c.SnapshotFile); err != nil {
+				log.Println("stats.snapshot:", err)
+			}
+		})
+		stopSnapshots = func() error {
+			stop()
+			return stats.SaveSnapshot(s, c.SnapshotFile)
+		}
+		defer stop()
 	}
 
+	// Synchronize the stats with the peers in the background
+	stopSync := func() {}
+	if m, ok := statsService.(stats.Mergeable); ok && len(c.Peers) > 0 {
+		interval := c.SyncInterval
+		if interval <= 0 {
+			interval = 5 * time.Second
+		}
+		p := newPeers(m, c.Peers, c.PeerSecret)
+		stop := every(interval, func(time.Time) { p.sync() })
+		stopSync = func() {
+			stop()
+			p.sync()
+		}
+		defer stop()
+	}
+
+	// Compact the stats in the background, until they are closed
+	retention := c.Retention
+	if retention == (stats.Retention{}) {
+		retention = stats.DefaultRetention
+	}
+	stopCompaction := every(time.Minute, func(now time.Time) {
+		if err := statsService.Compact(now, retention); err != nil {
+			log.Println("stats.compact:", err)
+		}
+	})
+	defer stopCompaction()
+
 	// Configure HTTP server
 	api := http.NewServeMux()
-	fb := handlers.Fizzbuzz(statsService)
+	fb := handlers.Fizzbuzz(stats.WithContext(statsService))
 	api.HandleFunc("/api/v2/fizzbuzz", fb.Handle)
 	api.HandleFunc("/api/v2/fizzbuzz/stats", fb.HandleStats)
-	api.HandleFunc("/api/v2/ready", func(http.ResponseWriter, *http.Request) {})
+	api.HandleFunc("/api/v2/fizzbuzz/stats/top", fb.HandleTop)
+	if m, ok := statsService.(stats.Mergeable); ok {
+		api.HandleFunc("/api/v2/fizzbuzz/stats/sync", handlers.Sync(m, c.PeerSecret))
+	}
+	api.HandleFunc("/api/v2/fizzbuzz/summary", fb.HandleSummary)
+	api.HandleFunc("/api/v2/ready", fb.HandleReady)
 	srv := http.Server{
 		Addr:         c.Addr,
 		Handler:      api,
@@ -82,10 +266,99 @@ func (c *Config) Run(ctx context.Context) error {
 		return fmt.Errorf("shutdown HTTP server: %w", err)
 	}
 
-	if c, ok := statsService.(io.Closer); ok {
-		return c.Close()
+	stopCompaction()
+	stopSync()
+	if err := stopSnapshots(); err != nil {
+		return fmt.Errorf("save snapshot: %w", err)
+	}
+	return nil
+}
+
+// redactURL returns rawURL with its password replaced by "xxxxx", so that it can be logged.
+func redactURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "(invalid URL)"
+	}
+	return u.Redacted()
+}
+
+// every calls f in a goroutine every interval, until the returned function is called, which waits for f to return.
+func every(interval time.Duration, f func(now time.Time)) (stop func()) {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case now := <-ticker.C:
+				f(now)
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(done) })
+		<-stopped
+	}
+}
+
+// peers synchronizes the stats with the peers.
+type peers struct {
+	m      stats.Mergeable
+	urls   []string
+	secret string
+	client http.Client
+	known  map[string]map[string]uint64 // known holds the versions of the stats of each peer, after the last synchronization
+}
+
+func newPeers(m stats.Mergeable, urls []string, secret string) *peers {
+	return &peers{
+		m:      m,
+		urls:   urls,
+		secret: secret,
+		client: http.Client{Timeout: 10 * time.Second},
+		known:  map[string]map[string]uint64{},
+	}
+}
+
+// sync pushes to each peer the stats it doesn't have yet, and merges the ones it answers.
+func (p *peers) sync() {
+	for _, url := range p.urls {
+		if err := p.syncWith(url); err != nil {
+			log.Println("stats.sync:", err)
+		}
 	}
+}
 
+func (p *peers) syncWith(url string) error {
+	var body bytes.Buffer
+	if err := p.m.Export(&body, p.known[url]); err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(url, "/")+"/api/v2/fizzbuzz/stats/sync", &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+p.secret)
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	versions, err := p.m.Merge(resp.Body)
+	if err != nil {
+		return fmt.Errorf("%s: %w", url, err)
+	}
+	p.known[url] = versions
 	return nil
 }
 
@@ -110,12 +383,57 @@ func run() error {
 	flag.StringVar(&c.DBFile, "db", defaultDBFile, `The path to the SQLite database file. Special values:
 	off         to disable SQLite (stats are kept in memory)
 	:memory:    to get an in-memory SQLite database
+	approx:N    to disable SQLite and keep approximate stats in memory, counting at most N distinct requests per time bucket (about 260×N in total with the default retention)
+	journal:DIR to disable SQLite and keep the stats in an append-only log in the directory DIR (no cgo needed)
+	postgres://... to disable SQLite and keep the stats in a PostgreSQL database: postgres://[user[:password]@]host[:port]/database[?param=value]
+	redis://... to disable SQLite and keep the stats in a Redis server: redis://[[user]:password@]host[:port][/database]
 `)
+	flag.DurationVar(&c.FlushInterval, "flush-interval", time.Second, "Maximum delay before the stats are written to the database, 0 to write them on each request")
+	flag.IntVar(&c.FlushSize, "flush-size", 10_000, "Number of distinct pending configs that triggers a write of the stats to the database")
+	flag.DurationVar(&c.StatsTimeout, "stats-timeout", time.Second, "Maximum duration of each call to the database, 0 to disable the circuit breaker")
+	flag.IntVar(&c.BreakerFailures, "breaker-failures", 5, "Number of consecutive failures of the database that opens the circuit breaker, the stats being then counted in memory")
+	flag.DurationVar(&c.BreakerCooldown, "breaker-cooldown", 10*time.Second, "Delay before the database is tried again, once the circuit breaker is open")
+	flag.DurationVar(&c.Retention.Minutes, "retention-minutes", stats.DefaultRetention.Minutes, "How long the stats are kept per minute, before being compacted per hour")
+	flag.DurationVar(&c.Retention.Hours, "retention-hours", stats.DefaultRetention.Hours, "How long the stats are kept per hour, before being compacted per day")
+	flag.DurationVar(&c.Retention.Days, "retention-days", stats.DefaultRetention.Days, "How long the stats are kept per day, before being dropped (the lifetime stats are kept)")
+	flag.StringVar(&c.NodeID, "node", "", "The unique ID of this replica among its peers, the one of the snapshot (-snapshot) if empty, random otherwise")
+	flag.Func("peers", "Comma-separated base URLs of the other replicas (such as http://10.0.0.2:8080), with which the in-memory stats (-db off) are synchronized", func(s string) error {
+		c.Peers = strings.Split(s, ",")
+		return nil
+	})
+	flag.StringVar(&c.PeerSecret, "peer-secret", os.Getenv("FIZZBUZZ_PEER_SECRET"), "The secret shared by the replicas, required to synchronize with the peers (FIZZBUZZ_PEER_SECRET environment variable by default)")
+	flag.DurationVar(&c.SyncInterval, "sync-interval", 5*time.Second, "Delay between two synchronizations of the stats with the peers")
+	flag.StringVar(&c.SnapshotFile, "snapshot", "", "The path to the file where the in-memory stats (-db off) are saved and restored, empty to disable snapshots")
+	flag.DurationVar(&c.SnapshotInterval, "snapshot-interval", time.Minute, "Delay between two snapshots of the in-memory stats")
 	flag.StringVar(&host, "host", "127.0.0.1", "address to bind to")
 	flag.IntVar(&port, "port", 8080, "listening port")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] [migrate status|up [VERSION]|down [VERSION]]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
 	flag.Parse()
 
+	// Run the migrate command instead of the server
+	if args := flag.Args(); len(args) > 0 {
+		if args[0] != "migrate" {
+			return fmt.Errorf("unknown command %q", args[0])
+		}
+		return Migrate(ctx, c.DBFile, args[1:], os.Stdout)
+	}
+
 	c.Addr = net.JoinHostPort(host, strconv.Itoa(port))
+	if c.FlushSize < 1 {
+		return errors.New("flush-size must be strictly positive")
+	}
+	if c.BreakerFailures < 1 {
+		return errors.New("breaker-failures must be strictly positive")
+	}
+	if c.SyncInterval <= 0 {
+		return errors.New("sync-interval must be strictly positive")
+	}
+	if c.SnapshotInterval <= 0 {
+		return errors.New("snapshot-interval must be strictly positive")
+	}
 
 	return c.Run(ctx)
 }
@@ -1,20 +1,31 @@
 package main_test
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"encoding/xml"
+	"errors"
 	"fmt"
 	"io"
+	"mime"
+	"mime/multipart"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/xpetit/fizzbuzz/v5"
 	main "github.com/xpetit/fizzbuzz/v5/cmd/fizzbuzzd"
+	"github.com/xpetit/fizzbuzz/v5/handlers"
+	"github.com/xpetit/fizzbuzz/v5/stats"
+	"github.com/xpetit/fizzbuzz/v5/stats/pgtest"
+	"github.com/xpetit/fizzbuzz/v5/stats/redistest"
 
 	"golang.org/x/exp/slices"
 )
@@ -35,7 +46,8 @@ func equal[T comparable](t *testing.T, descr string, got, want T) {
 	}
 }
 
-func testMain(t *testing.T, c main.Config) {
+// testMain checks the API served with the config c, and returns the last most frequent request.
+func testMain(t *testing.T, c main.Config) (int, fizzbuzz.Config) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
@@ -74,6 +86,21 @@ func testMain(t *testing.T, c main.Config) {
 		}
 	}
 
+	// The state of the circuit breaker is reported, if any
+	{
+		_, b, err := request("GET", "ready")
+		check(t, err)
+		var ready struct {
+			Breaker string `json:"stats_breaker"`
+		}
+		check(t, json.Unmarshal(b, &ready))
+		wantBreaker := ""
+		if c.StatsTimeout > 0 { // only set with SQLite by these tests
+			wantBreaker = "closed"
+		}
+		equal(t, "breaker state", ready.Breaker, wantBreaker)
+	}
+
 	assertBadRequest := func(t *testing.T, method, path string) {
 		t.Helper()
 		code, b, err := request(method, path)
@@ -97,7 +124,7 @@ func testMain(t *testing.T, c main.Config) {
 		http.MethodOptions,
 		http.MethodTrace,
 	}
-	paths := []string{"fizzbuzz", "fizzbuzz/stats"}
+	paths := []string{"fizzbuzz", "fizzbuzz/stats", "fizzbuzz/stats/top", "fizzbuzz/summary"}
 	for _, path := range paths {
 		for _, method := range invalidMethods {
 			assertBadRequest(t, method, path)
@@ -121,12 +148,28 @@ func testMain(t *testing.T, c main.Config) {
 		"?int1=",
 		"?int2=",
 		"?;",
+		"?offset=-1",
+		"?offset=",
+		"?offset=a",
+		"?count=0",
+		"?count=-1",
+		"?count=",
+		"?format=",
+		"?format=yaml",
+		"?shape=",
+		"?shape=maps",
+		"?format=csv&shape=objects",
 	}
 	for _, query := range invalidQueries {
 		assertBadRequest(t, "GET", "fizzbuzz"+query)
 	}
 
-	assertStats := func(t *testing.T, count int, cfg fizzbuzz.Config) {
+	// fizzbuzz/summary endpoint only accepts the config query parameters
+	for _, query := range []string{"?unknown", "?limit=a", "?int1=0", "?int2=-1", "?offset=1", "?format=json"} {
+		assertBadRequest(t, "GET", "fizzbuzz/summary"+query)
+	}
+
+	assertStatsIn := func(t *testing.T, query string, count int, cfg fizzbuzz.Config) {
 		t.Helper()
 		var stats struct {
 			MostFrequent struct {
@@ -134,13 +177,17 @@ func testMain(t *testing.T, c main.Config) {
 				Count  int             `json:"count"`
 			} `json:"most_frequent"`
 		}
-		code, b, err := request("GET", "fizzbuzz/stats")
+		code, b, err := request("GET", "fizzbuzz/stats"+query)
 		check(t, err)
 		equal(t, "HTTP code", code, http.StatusOK)
 		check(t, json.Unmarshal(b, &stats))
 		equal(t, "stats count", stats.MostFrequent.Count, count)
 		equal(t, "stats config", stats.MostFrequent.Config, cfg)
 	}
+	assertStats := func(t *testing.T, count int, cfg fizzbuzz.Config) {
+		t.Helper()
+		assertStatsIn(t, "", count, cfg)
+	}
 
 	getFizzbuzz := func(t *testing.T, cfg fizzbuzz.Config) (res []string) {
 		t.Helper()
@@ -246,9 +293,264 @@ func testMain(t *testing.T, c main.Config) {
 		}
 	}
 
-	// Stop API
+	// Fizz buzz can be paged
+	getPage := func(t *testing.T, query string) (page []string, total string, links map[string]string) {
+		t.Helper()
+		resp, err := client.Get("http://" + c.Addr + "/api/v2/fizzbuzz?" + query)
+		check(t, err)
+		defer resp.Body.Close()
+		equal(t, "HTTP code", resp.StatusCode, http.StatusOK)
+		check(t, json.NewDecoder(resp.Body).Decode(&page))
+		links = map[string]string{}
+		for _, link := range strings.Split(resp.Header.Get("Link"), ", ") {
+			if target, rel, ok := strings.Cut(link, "; rel="); ok {
+				links[strings.Trim(rel, `"`)] = strings.Trim(target, "<>")
+			}
+		}
+		return page, resp.Header.Get("X-Total-Count"), links
+	}
+	whole := getFizzbuzz(t, fizzbuzz.Config{Limit: 25, Int1: 3, Int2: 5, Str1: "fizz", Str2: "buzz"})
+	var stitched []string
+	next := "/api/v2/fizzbuzz?limit=25&int1=3&int2=5&count=10"
+	for next != "" {
+		u, err := url.Parse(next)
+		check(t, err)
+		page, total, links := getPage(t, u.RawQuery)
+		equal(t, "total count", total, "25")
+		equal(t, "first link", links["first"] != "", true)
+		equal(t, "last link", links["last"], "/api/v2/fizzbuzz?count=10&int1=3&int2=5&limit=25&offset=20")
+		stitched = append(stitched, page...)
+		next = links["next"]
+	}
+	if !slices.Equal(stitched, whole) {
+		t.Fatalf(gotWant, stitched, whole)
+	}
+	page, _, links := getPage(t, "limit=25&int1=3&int2=5&offset=15&count=10")
+	equal(t, "page", fmt.Sprint(page), fmt.Sprint(whole[15:25]))
+	equal(t, "prev link", links["prev"], "/api/v2/fizzbuzz?count=10&int1=3&int2=5&limit=25&offset=5")
+	equal(t, "next link", links["next"], "")
+	page, _, _ = getPage(t, "limit=25&int1=3&int2=5&offset=30")
+	equal(t, "page after the end", len(page), 0)
+
+	// Paged requests are counted against the whole Fizz buzz config
+	assertStats(t, 7, baseConf)
+	getPage(t, "limit=13&int1=3&int2=4&offset=2&count=3")
+	assertStats(t, 8, baseConf)
+
+	// The stats can be restricted to a time window
+	now := time.Now()
+	assertStatsIn(t, "?window=1h", 8, baseConf)
+	assertStatsIn(t, "?"+url.Values{"since": {now.Add(-time.Hour).Format(time.RFC3339)}}.Encode(), 8, baseConf)
+	assertStatsIn(t, "?"+url.Values{"until": {now.Add(-time.Hour).Format(time.RFC3339)}}.Encode(), 0, fizzbuzz.Config{})
+	assertStatsIn(t, "?"+url.Values{"until": {now.Add(-time.Hour).Format(time.RFC3339)}, "window": {"24h"}}.Encode(), 0, fizzbuzz.Config{})
+	assertStatsIn(t, "?"+url.Values{"since": {now.Add(time.Hour).Format(time.RFC3339)}}.Encode(), 0, fizzbuzz.Config{})
+	for _, query := range []string{
+		"?window=",
+		"?window=1",
+		"?window=-1h",
+		"?since=yesterday",
+		"?until=",
+		"?since=2023-01-01T00:00:00Z&window=1h",
+		"?since=2023-01-02T00:00:00Z&until=2023-01-01T00:00:00Z",
+	} {
+		assertBadRequest(t, "GET", "fizzbuzz/stats"+query)
+	}
+
+	// The most frequent configs can be filtered, and have the same order in all backends
+	type entry struct {
+		Count  int             `json:"count"`
+		Config fizzbuzz.Config `json:"config"`
+	}
+	assertTop := func(t *testing.T, query string, want ...entry) {
+		t.Helper()
+		var top struct {
+			Top []entry `json:"top"`
+		}
+		code, b, err := request("GET", "fizzbuzz/stats/top?"+query)
+		check(t, err)
+		equal(t, "HTTP code", code, http.StatusOK)
+		check(t, json.Unmarshal(b, &top))
+		if !slices.Equal(top.Top, want) {
+			t.Fatalf(query+gotWant, top.Top, want)
+		}
+	}
+	below := baseConf
+	below.Limit--
+	above := baseConf
+	above.Limit++
+	assertTop(t, "n=1", entry{8, baseConf})
+	assertTop(t, "int1=3&int2=4&str1_prefix=fi", entry{8, baseConf}, entry{1, below}, entry{1, above})
+	assertTop(t, "int1=3&int2=4&str1_prefix=fi&str2_prefix=bu&n=2", entry{8, baseConf}, entry{1, below})
+	assertTop(t, "min_limit=14&max_limit=14&int1=3", entry{1, above})
+	assertTop(t, "max_limit=12&str1_prefix=a&n=2",
+		entry{1, fizzbuzz.Config{Limit: -1, Str1: "a", Str2: "", Int1: 1, Int2: 1}},
+		entry{1, fizzbuzz.Config{Limit: -1, Str1: "a", Str2: "a", Int1: 1, Int2: 1}},
+	)
+	assertTop(t, "str1_prefix=%22", entry{1, fizzbuzz.Config{Limit: 1, Str1: `"`, Str2: "", Int1: 1, Int2: 1}})
+	assertTop(t, "str1_prefix=%25")
+	assertTop(t, "str1_prefix=_")
+	assertTop(t, "min_limit=14&max_limit=13")
+	for _, query := range []string{"?unknown", "?n=0", "?n=1001", "?n=", "?int1=a", "?min_limit=", "?limit=1"} {
+		assertBadRequest(t, "GET", "fizzbuzz/stats/top"+query)
+	}
+
+	// The summary gives the counts and size of Fizz buzz without generating it
+	var summary struct {
+		Counts struct {
+			Number, Int1, Int2, Both, Bytes int
+		} `json:"counts"`
+		Config fizzbuzz.Config `json:"config"`
+	}
+	code, b, err := request("GET", "fizzbuzz/summary?limit=15&int1=3&int2=5")
+	check(t, err)
+	equal(t, "HTTP code", code, http.StatusOK)
+	check(t, json.Unmarshal(b, &summary))
+	equal(t, "config", summary.Config, fizzbuzz.Config{Limit: 15, Int1: 3, Int2: 5, Str1: "fizz", Str2: "buzz"})
+	equal(t, "numbers", summary.Counts.Number, 8)
+	equal(t, "int1", summary.Counts.Int1, 4)
+	equal(t, "int2", summary.Counts.Int2, 2)
+	equal(t, "both", summary.Counts.Both, 1)
+	_, b, err = request("GET", "fizzbuzz?limit=15&int1=3&int2=5")
+	check(t, err)
+	equal(t, "bytes", summary.Counts.Bytes, len(b))
+	code, b, err = request("GET", "fizzbuzz/summary?limit=9223372036854775807")
+	check(t, err)
+	equal(t, "HTTP code", code, http.StatusOK)
+	equal(t, "bytes exceeding int64", strings.Contains(string(b), `"bytes":116459008763123456536}`), true)
+
+	// Fizz buzz supports byte ranges
+	getRange := func(t *testing.T, header http.Header, wantCode int) (*http.Response, []byte) {
+		t.Helper()
+		req, err := http.NewRequest("GET", "http://"+c.Addr+"/api/v2/fizzbuzz?limit=100", nil)
+		check(t, err)
+		req.Header = header
+		resp, err := client.Do(req)
+		check(t, err)
+		defer resp.Body.Close()
+		b, err := io.ReadAll(resp.Body)
+		check(t, err)
+		equal(t, "HTTP code", resp.StatusCode, wantCode)
+		return resp, b
+	}
+	resp, full := getRange(t, http.Header{}, http.StatusOK)
+	equal(t, "Content-Length", resp.Header.Get("Content-Length"), strconv.Itoa(len(full)))
+	equal(t, "Accept-Ranges", resp.Header.Get("Accept-Ranges"), "bytes")
+	etag := resp.Header.Get("ETag")
+	equal(t, "ETag is strong", strings.HasPrefix(etag, `"`), true)
+
+	_, part := getRange(t, http.Header{"Range": {"bytes=10-19"}}, http.StatusPartialContent)
+	equal(t, "range", string(part), string(full[10:20]))
+	_, part = getRange(t, http.Header{"Range": {"bytes=-5"}}, http.StatusPartialContent)
+	equal(t, "suffix range", string(part), string(full[len(full)-5:]))
+
+	resp, body := getRange(t, http.Header{"Range": {"bytes=0-4,50-59"}}, http.StatusPartialContent)
+	mediaType, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	check(t, err)
+	equal(t, "media type", mediaType, "multipart/byteranges")
+	mr := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+	for _, want := range []string{string(full[0:5]), string(full[50:60])} {
+		p, err := mr.NextPart()
+		check(t, err)
+		got, err := io.ReadAll(p)
+		check(t, err)
+		equal(t, "multipart range", string(got), want)
+	}
+
+	_, part = getRange(t, http.Header{"Range": {"bytes=10-19"}, "If-Range": {etag}}, http.StatusPartialContent)
+	equal(t, "range with matching If-Range", string(part), string(full[10:20]))
+	_, part = getRange(t, http.Header{"Range": {"bytes=10-19"}, "If-Range": {`"outdated"`}}, http.StatusOK)
+	equal(t, "range with outdated If-Range", string(part), string(full))
+
+	// Only the ranges that are served are counted
+	rangeCount := func(t *testing.T) int {
+		t.Helper()
+		var top struct {
+			Top []entry `json:"top"`
+		}
+		code, b, err := request("GET", "fizzbuzz/stats/top?min_limit=100&max_limit=100&n=1")
+		check(t, err)
+		equal(t, "HTTP code", code, http.StatusOK)
+		check(t, json.Unmarshal(b, &top))
+		if len(top.Top) == 0 {
+			return 0
+		}
+		return top.Top[0].Count
+	}
+	count := rangeCount(t)
+	getRange(t, http.Header{"Range": {"bytes=100000-"}}, http.StatusRequestedRangeNotSatisfiable)
+	getRange(t, http.Header{"Range": {"bytes=10-19"}, "If-None-Match": {etag}}, http.StatusNotModified)
+	equal(t, "count after unserved ranges", rangeCount(t), count)
+	getRange(t, http.Header{"Range": {"bytes=0-19"}}, http.StatusPartialContent)
+	equal(t, "count after a served range", rangeCount(t), count+1)
+
+	// A resumed transfer is counted once, by its first range
+	count = rangeCount(t)
+	var resumed []byte
+	for _, r := range []string{"bytes=0-99", "bytes=100-199", fmt.Sprintf("bytes=200-%d", len(full)-1)} {
+		_, part := getRange(t, http.Header{"Range": {r}, "If-Range": {etag}}, http.StatusPartialContent)
+		resumed = append(resumed, part...)
+	}
+	equal(t, "resumed transfer", string(resumed), string(full))
+	equal(t, "count after a resumed transfer", rangeCount(t), count+1)
+	getRange(t, http.Header{"Range": {"bytes=10-19"}}, http.StatusPartialContent)
+	getRange(t, http.Header{"Range": {"bytes=-5"}}, http.StatusPartialContent)
+	equal(t, "count after ranges not starting at the first byte", rangeCount(t), count+1)
+	getRange(t, http.Header{"Range": {"bytes=10-19"}, "If-Range": {`"outdated"`}}, http.StatusOK)
+	equal(t, "count after a full response to a range", rangeCount(t), count+2)
+
+	// Fizz buzz is available in several formats, chosen with the Accept header or the format query parameter
+	getFormat := func(t *testing.T, query, accept string, wantCode int) (contentType string, body string) {
+		t.Helper()
+		req, err := http.NewRequest("GET", "http://"+c.Addr+"/api/v2/fizzbuzz?limit=3&"+query, nil)
+		check(t, err)
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		resp, err := client.Do(req)
+		check(t, err)
+		defer resp.Body.Close()
+		b, err := io.ReadAll(resp.Body)
+		check(t, err)
+		equal(t, "HTTP code", resp.StatusCode, wantCode)
+		return resp.Header.Get("Content-Type"), string(b)
+	}
+	formatTests := []struct {
+		query, accept, contentType, body string
+	}{
+		{"", "", "application/json; charset=utf-8", `["1","fizz","buzz"]` + "\n"},
+		{"", "*/*", "application/json; charset=utf-8", `["1","fizz","buzz"]` + "\n"},
+		{"", "application/x-ndjson", "application/x-ndjson; charset=utf-8", "\"1\"\n\"fizz\"\n\"buzz\"\n"},
+		{"", "text/csv;q=0.5, text/*;q=0.8", "text/plain; charset=utf-8", "1\nfizz\nbuzz\n"},
+		{"", "text/*, text/plain;q=0", "text/csv; charset=utf-8", "index,value,kind\n1,1,number\n2,fizz,int1\n3,buzz,int2\n"},
+		{"", "application/xml, application/json;q=0.9", "application/xml; charset=utf-8", xml.Header + "<fizzbuzz><value>1</value><value>fizz</value><value>buzz</value></fizzbuzz>\n"},
+		{"format=text", "application/json", "text/plain; charset=utf-8", "1\nfizz\nbuzz\n"},
+		{"", "application/cbor", "application/cbor", "\x9f\x01\x64fizz\x64buzz\xff"},
+		{"format=msgpack", "", "application/msgpack", "\x93\x01\xa4fizz\xa4buzz"},
+		{"shape=objects&offset=1", "", "application/json; charset=utf-8", `[{"n":2,"value":"fizz","kind":"int1"},{"n":3,"value":"buzz","kind":"int2"}]` + "\n"},
+		{"shape=tuples", "application/x-ndjson", "application/x-ndjson; charset=utf-8", `[1,"1","number"]` + "\n" + `[2,"fizz","int1"]` + "\n" + `[3,"buzz","int2"]` + "\n"},
+	}
+	for _, test := range formatTests {
+		contentType, body := getFormat(t, test.query, test.accept, http.StatusOK)
+		equal(t, "Content-Type", contentType, test.contentType)
+		equal(t, "body", body, test.body)
+	}
+	contentType, errBody := getFormat(t, "", "image/png, text/plain;q=0", http.StatusNotAcceptable)
+	equal(t, "Content-Type", contentType, "application/json; charset=utf-8")
+	equal(t, "error", strings.Contains(errBody, `"error"`), true)
+
+	// Stop API, after getting the last stats
+	var last struct {
+		MostFrequent struct {
+			Config fizzbuzz.Config `json:"config"`
+			Count  int             `json:"count"`
+		} `json:"most_frequent"`
+	}
+	_, b, err = request("GET", "fizzbuzz/stats")
+	check(t, err)
+	check(t, json.Unmarshal(b, &last))
 	cancel()
 	check(t, <-runErr)
+	return last.MostFrequent.Count, last.MostFrequent.Config
 }
 
 func TestMain(t *testing.T) {
@@ -261,11 +563,134 @@ func TestMain(t *testing.T) {
 	case !t.Run("map", func(t *testing.T) {
 		testMain(t, main.Config{Addr: addr, DBFile: "off"})
 	}):
+	case !t.Run("snapshot", func(t *testing.T) {
+		file := filepath.Join(t.TempDir(), "stats.snapshot")
+		wantCount, wantCfg := testMain(t, main.Config{Addr: addr, DBFile: "off", SnapshotFile: file})
+
+		// The stats are saved on shutdown
+		s := stats.Memory()
+		check(t, stats.LoadSnapshot(s, file))
+		count, cfg, err := s.MostFrequent()
+		check(t, err)
+		equal(t, "restored count", count, wantCount)
+		equal(t, "restored config", cfg, wantCfg)
+	}):
+	case !t.Run("replicated", func(t *testing.T) {
+		peer := stats.Replicated("peer")
+		srv := httptest.NewServer(handlers.Sync(peer, "secret"))
+		defer srv.Close()
+
+		// The peers must share the secret
+		resp, err := http.Post(srv.URL, "application/json", strings.NewReader(`{"nodes":[]}`))
+		check(t, err)
+		resp.Body.Close()
+		equal(t, "status without secret", resp.StatusCode, http.StatusUnauthorized)
+		err = (&main.Config{Addr: addr, DBFile: "off", Peers: []string{srv.URL}}).Run(context.Background())
+		if err == nil || !strings.Contains(err.Error(), "-peer-secret") {
+			t.Fatalf("got %v, want an error requiring a secret", err)
+		}
+
+		wantCount, wantCfg := testMain(t, main.Config{Addr: addr, DBFile: "off", NodeID: "node", Peers: []string{srv.URL}, PeerSecret: "secret", SyncInterval: 50 * time.Millisecond})
+
+		// The stats are synchronized on shutdown
+		count, cfg, err := peer.MostFrequent()
+		check(t, err)
+		equal(t, "synchronized count", count, wantCount)
+		equal(t, "synchronized config", cfg, wantCfg)
+	}):
+	case !t.Run("approx", func(t *testing.T) {
+		testMain(t, main.Config{Addr: addr, DBFile: "approx:1000"})
+	}):
+	case !t.Run("journal", func(t *testing.T) {
+		dir := filepath.Join(t.TempDir(), "journal")
+		wantCount, wantCfg := testMain(t, main.Config{Addr: addr, DBFile: "journal:" + dir})
+
+		// The stats are persisted
+		s, err := stats.OpenJournal(dir)
+		check(t, err)
+		defer s.Close()
+		count, cfg, err := s.MostFrequent()
+		check(t, err)
+		equal(t, "restored count", count, wantCount)
+		equal(t, "restored config", cfg, wantCfg)
+	}):
+	case !t.Run("redis", func(t *testing.T) {
+		server := redistest.NewServer()
+		defer server.Close()
+		wantCount, wantCfg := testMain(t, main.Config{Addr: addr, DBFile: server.URL, StatsTimeout: time.Second, BreakerFailures: 3, BreakerCooldown: time.Second})
+
+		// The stats are persisted
+		s, err := stats.OpenRedis(context.Background(), server.URL)
+		check(t, err)
+		defer s.Close()
+		count, cfg, err := s.MostFrequent()
+		check(t, err)
+		equal(t, "persisted count", count, wantCount)
+		equal(t, "persisted config", cfg, wantCfg)
+	}):
+	case !t.Run("postgres", func(t *testing.T) {
+		server, err := pgtest.NewServer()
+		if errors.Is(err, pgtest.ErrUnavailable) {
+			t.Skip(err)
+		}
+		check(t, err)
+		defer server.Close()
+		dsn, err := server.NewDatabase()
+		check(t, err)
+		wantCount, wantCfg := testMain(t, main.Config{Addr: addr, DBFile: dsn, StatsTimeout: time.Second, BreakerFailures: 3, BreakerCooldown: time.Second})
+
+		// The stats are persisted
+		s, err := stats.OpenPostgres(context.Background(), dsn)
+		check(t, err)
+		defer s.Close()
+		count, cfg, err := s.MostFrequent()
+		check(t, err)
+		equal(t, "persisted count", count, wantCount)
+		equal(t, "persisted config", cfg, wantCfg)
+	}):
 	case !t.Run("memory_DB", func(t *testing.T) {
 		testMain(t, main.Config{Addr: addr, DBFile: ":memory:"})
 	}):
 	case !t.Run("file_DB", func(t *testing.T) {
 		testMain(t, main.Config{Addr: addr, DBFile: filepath.Join(t.TempDir(), "data.db")})
 	}):
+	case !t.Run("resilient_DB", func(t *testing.T) {
+		testMain(t, main.Config{Addr: addr, DBFile: filepath.Join(t.TempDir(), "data.db"), FlushInterval: time.Hour, FlushSize: 3, StatsTimeout: time.Second, BreakerFailures: 3, BreakerCooldown: time.Second})
+	}):
+	case !t.Run("buffered_DB", func(t *testing.T) {
+		testMain(t, main.Config{Addr: addr, DBFile: filepath.Join(t.TempDir(), "data.db"), FlushInterval: time.Hour, FlushSize: 3})
+	}):
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	ctx := context.Background()
+	file := filepath.Join(t.TempDir(), "data.db")
+	migrate := func(args ...string) string {
+		t.Helper()
+		var b strings.Builder
+		check(t, main.Migrate(ctx, file, args, &b))
+		return b.String()
+	}
+	last := len(stats.Migrations())
+
+	if err := main.Migrate(ctx, file, []string{"status"}, io.Discard); err == nil {
+		t.Fatal("the status of a missing database must fail")
+	}
+	equal(t, "up", migrate("up"), fmt.Sprintf("Migrated from schema version 0 to %d\n", last))
+	status := migrate("status")
+	equal(t, "status header", strings.SplitN(status, "\n", 2)[0], fmt.Sprintf("Schema version %d of %d", last, last))
+	equal(t, "pending migrations", strings.Count(status, "pending"), 0)
+	equal(t, "down", migrate("down"), fmt.Sprintf("Migrated from schema version %d to %d\n", last, last-1))
+	equal(t, "pending migrations", strings.Count(migrate("status"), "pending"), 1)
+	equal(t, "down to 0", migrate("down", "0"), fmt.Sprintf("Migrated from schema version %d to 0\n", last-1))
+
+	for _, args := range [][]string{{}, {"down"}, {"up", "x"}, {"down", "1"}, {"up", strconv.Itoa(last + 1)}, {"sideways"}} {
+		if err := main.Migrate(ctx, file, args, io.Discard); err == nil {
+			t.Fatalf("migrate %q must fail", args)
+		}
+	}
+	if err := main.Migrate(ctx, "off", []string{"status"}, io.Discard); err == nil {
+		t.Fatal("the in-memory stats can't be migrated")
 	}
 }
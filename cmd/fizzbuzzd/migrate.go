@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/xpetit/fizzbuzz/v5/stats"
+)
+
+// Migrate runs the migrate command on the SQLite database file, writing its report to w. The arguments are:
+//
+//	status          to print the version of the schema and the migrations
+//	up [VERSION]    to apply the migrations up to VERSION, the last one by default
+//	down [VERSION]  to revert the migrations down to VERSION, the previous one by default
+func Migrate(ctx context.Context, dbFile string, args []string, w io.Writer) error {
+	if dbFile == "off" || dbFile == ":memory:" || strings.HasPrefix(dbFile, "approx:") || strings.HasPrefix(dbFile, "journal:") ||
+		strings.Contains(dbFile, "://") {
+		return errors.New("migrations are only available for SQLite database files (-db path/to/file)")
+	}
+	if len(args) == 0 || len(args) > 2 {
+		return errors.New("usage: migrate status|up [VERSION]|down [VERSION]")
+	}
+	cmd := args[0]
+	if cmd != "up" {
+		// Don't create the database to report or revert its migrations
+		if _, err := os.Stat(dbFile); err != nil {
+			return err
+		}
+	}
+	current, err := stats.SchemaVersion(ctx, dbFile)
+	if err != nil {
+		return err
+	}
+	migrations := stats.Migrations()
+
+	var version int
+	switch {
+	case cmd == "status" && len(args) == 1:
+		fmt.Fprintf(w, "Schema version %d of %d\n", current, len(migrations))
+		for _, m := range migrations {
+			state := "pending"
+			if m.Version <= current {
+				state = "applied"
+			}
+			fmt.Fprintf(w, "%4d %-7s %s\n", m.Version, state, m.Name)
+		}
+		return nil
+	case cmd == "up" && len(args) == 1:
+		version = len(migrations)
+	case cmd == "down" && len(args) == 1:
+		version = current - 1
+		if version < 0 {
+			return errors.New("no migration to revert")
+		}
+	case cmd == "up" || cmd == "down":
+		if version, err = strconv.Atoi(args[1]); err != nil {
+			return fmt.Errorf("invalid schema version %q: must be an integer", args[1])
+		}
+		if cmd == "up" && version < current || cmd == "down" && version > current {
+			return fmt.Errorf("cannot migrate %s from schema version %d to %d", cmd, current, version)
+		}
+	default:
+		return fmt.Errorf("unknown migrate command %q", strings.Join(args, " "))
+	}
+
+	if err := stats.MigrateDB(ctx, dbFile, version); err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "Migrated from schema version %d to %d\n", current, version)
+	return nil
+}
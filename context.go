@@ -0,0 +1,35 @@
+package fizzbuzz
+
+import (
+	"context"
+	"io"
+)
+
+// Progress is called after each chunk of values written, with the number of values and bytes written so far.
+type Progress func(values int, bytes int64)
+
+// chunkWriter writes chunks of values, checking the context before each one and reporting the progress after.
+type chunkWriter struct {
+	ctx      context.Context
+	w        io.Writer
+	progress Progress
+	n        int64 // n is the number of bytes written
+	err      error // err is the first error encountered
+}
+
+// write writes a chunk that completes the first values, and returns false if the writing failed or the context is done.
+func (cw *chunkWriter) write(b []byte, values int) bool {
+	if cw.err = cw.ctx.Err(); cw.err != nil {
+		return false
+	}
+	var nn int
+	nn, cw.err = cw.w.Write(b)
+	cw.n += int64(nn)
+	if cw.err != nil {
+		return false
+	}
+	if cw.progress != nil {
+		cw.progress(values, cw.n)
+	}
+	return true
+}
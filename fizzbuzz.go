@@ -1,11 +1,11 @@
 package fizzbuzz
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
-	"strconv"
 )
 
 // Config contains the Fizz buzz parameters.
@@ -17,7 +17,7 @@ type Config struct {
 	Int2  int    `json:"int2"`  // Int2 is the second divisor
 }
 
-// ErrInvalidInput is returned by WriteTo when attempting to write an invalid config (negative or zero Int1/Int2).
+// ErrInvalidInput is returned by WriteTo when attempting to write an invalid config (negative or zero divisors).
 var ErrInvalidInput = errors.New("invalid input")
 
 // Default returns a default configuration that gives all possible types of Fizz buzz values.
@@ -31,8 +31,35 @@ func Default() Config {
 	}
 }
 
-// Ensure type implements interface.
-var _ io.WriterTo = (*Config)(nil)
+// validate returns an ErrInvalidInput if Int1 or Int2 is negative or zero.
+func (c *Config) validate() error {
+	if c.Int1 < 1 {
+		return fmt.Errorf("%w: Int1 must be strictly positive", ErrInvalidInput)
+	}
+	if c.Int2 < 1 {
+		return fmt.Errorf("%w: Int2 must be strictly positive", ErrInvalidInput)
+	}
+	return nil
+}
+
+// Rules returns the rule-based equivalent of the config: Int1/Str1 followed by Int2/Str2.
+func (c *Config) Rules() RuleConfig {
+	return RuleConfig{
+		Rules: []Rule{
+			{Str: c.Str1, Divisor: c.Int1},
+			{Str: c.Str2, Divisor: c.Int2},
+		},
+		Limit: c.Limit,
+	}
+}
+
+// Ensure types implement interface.
+var (
+	_ io.WriterTo   = (*Config)(nil)
+	_ io.WriterTo   = (*RuleConfig)(nil)
+	_ io.ReadSeeker = (*Reader)(nil)
+	_ io.ReaderAt   = (*Reader)(nil)
+)
 
 // asIs returns whether the string can be copied as is (no characters to escape)
 func asIs(s string) bool {
@@ -56,96 +83,48 @@ func marshalJSON(s string) (b []byte) {
 	return
 }
 
-var (
-	empty = []byte("[]\n")
-	end   = []byte("]\n")
-)
+var empty = []byte("[]\n")
 
 // WriteTo writes a list of Fizz buzz values as a JSON array of strings, followed by a newline character.
 //
 // Attempting to write a Fizz buzz with negative or zero divisors causes WriteTo to return an ErrInvalidInput.
 // Any other errors reported may be due to w.Write.
 func (c *Config) WriteTo(w io.Writer) (n int64, err error) {
-	// Check the config validity
-	if c.Int1 < 1 {
-		return 0, fmt.Errorf("%w: Int1 must be strictly positive", ErrInvalidInput)
-	}
-	if c.Int2 < 1 {
-		return 0, fmt.Errorf("%w: Int2 must be strictly positive", ErrInvalidInput)
-	}
+	return c.WriteRange(w, 1, c.Limit)
+}
 
-	// write accumulates the n bytes and returns false if the writing failed
-	write := func(b []byte) bool {
-		var nn int
-		nn, err = w.Write(b)
-		n += int64(nn)
-		return err == nil
-	}
+// WriteRange is like WriteTo but only writes the values from position from to position to (both included, 1 being the first).
+// The range is clamped to the values of the Fizz buzz, so the array is empty if it doesn't contain any of them.
+//
+// The values are computed directly from the divisors, so the ones before from are never produced.
+// The array contains the same JSON strings as WriteTo for the same positions.
+func (c *Config) WriteRange(w io.Writer, from, to int) (n int64, err error) {
+	return c.WriteRangeContext(context.Background(), w, from, to, nil)
+}
 
-	if c.Limit < 1 {
-		// Fizz buzz starts with 1, so return an empty array
-		write(empty)
-		return
-	}
+// WriteToContext is like WriteTo but stops with the context error as soon as ctx is done.
+// The context is checked before writing each chunk of values, and progress (if not nil) is called after.
+func (c *Config) WriteToContext(ctx context.Context, w io.Writer, progress Progress) (n int64, err error) {
+	return c.WriteRangeContext(ctx, w, 1, c.Limit, progress)
+}
 
-	// Open the JSON array
-	if !write([]byte{'['}) {
-		return
+// WriteRangeContext is like WriteRange but stops with the context error as soon as ctx is done.
+// The context is checked before writing each chunk of values, and progress (if not nil) is called after.
+func (c *Config) WriteRangeContext(ctx context.Context, w io.Writer, from, to int, progress Progress) (n int64, err error) {
+	if err := c.validate(); err != nil {
+		return 0, err
 	}
+	rc := c.Rules()
+	return rc.WriteRangeContext(ctx, w, from, to, progress)
+}
 
-	s1 := marshalJSON(c.Str1)
-	s2 := marshalJSON(c.Str2)
-
-	// Instead of marshalling str1+str2, reuse the previous JSON strings, without the quotes
-	s12 := make([]byte, 0, len(s1)-1+len(s2)-1) // Allocate a slice big enough to contain s1 and s2 without the quotes
-	s12 = append(s12, s1[:len(s1)-1]...)        // append [s1)
-	s12 = append(s12, s2[1:]...)                // append (s2]
-
-	// buf is used to accumulate the bytes for a Fizz buzz JSON string
-	var buf []byte
-
-	// intBuf is a buffer big enough to hold math.MaxInt (9223372036854775807), used to format an int
-	intBuf := make([]byte, 0, 19)
-
-	// Iterate over all Fizz buzz values and write them one by one
-	for i := 1; ; i++ {
-		if i%c.Int1 == 0 {
-			if i%c.Int2 == 0 {
-				// i is divisible by both Int1 and Int2, append Str1+Str2 JSON string
-				buf = append(buf, s12...)
-			} else {
-				// i is only divisible by Int1, append Str1 JSON string
-				buf = append(buf, s1...)
-			}
-		} else if i%c.Int2 == 0 {
-			// i is only divisible by Int2, append Str2 JSON string
-			buf = append(buf, s2...)
-		} else {
-			// i is not divisible by either Int1 or Int2, append the current number i as a JSON string
-			buf = append(buf, '"')
-			buf = append(buf, strconv.AppendInt(intBuf, int64(i), 10)...)
-			buf = append(buf, '"')
-		}
-
-		// If we haven't reached the last Fizz buzz value, add a comma (the JSON array separator)
-		if i < c.Limit {
-			buf = append(buf, ',')
-		}
-
-		// Finally, write the buffer
-		if !write(buf) {
-			return
-		}
-
-		if i == c.Limit {
-			break
-		}
-
-		// Truncate the slice while keeping the underlying storage intact to avoid unnecessary memory allocations
-		buf = buf[:0]
+// ValueAt returns the Fizz buzz value at position i (1 being the first).
+//
+// It returns an ErrInvalidInput if the config is invalid or if i is not between 1 and Limit.
+func (c *Config) ValueAt(i int) (string, error) {
+	if err := c.validate(); err != nil {
+		return "", err
 	}
-
-	// Close JSON array and add a newline to be consistent with (*json.Encoder).Encode
-	write(end)
-	return
+	rc := c.Rules()
+	return rc.ValueAt(i)
 }
@@ -1,10 +1,15 @@
 package fizzbuzz_test
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"math"
 	"os"
+	"strconv"
 	"testing"
 
 	"github.com/xpetit/fizzbuzz/v5"
@@ -22,6 +27,380 @@ func Example() {
 	// ["1","2","a","4","b","a","7","8","a","b","11","a","13","14","ab"]
 }
 
+func ExampleRuleConfig() {
+	c := fizzbuzz.RuleConfig{
+		Rules: []fizzbuzz.Rule{
+			{Divisor: 2, Str: "fizz"},
+			{Divisor: 3, Str: "buzz"},
+			{Divisor: 5, Str: "bazz"},
+			{Divisor: 7, Str: "pop"},
+		},
+		Limit: 15,
+	}
+	c.WriteTo(os.Stdout)
+
+	// Output:
+	// ["1","fizz","buzz","fizz","bazz","fizzbuzz","pop","fizz","buzz","fizzbazz","11","fizzbuzz","13","fizzpop","buzzbazz"]
+}
+
+// TestWriteTo compares WriteTo to a naive implementation, with periods smaller and bigger than the limit
+func TestWriteTo(t *testing.T) {
+	strs := []string{"", "fizz", `"`, "👌🏻"}
+	for _, limit := range []int{-1, 0, 1, 2, 5, 12, 13, 100, 1000, 5000} {
+		for int1 := 1; int1 <= 17; int1 += 4 {
+			for int2 := 1; int2 <= 101; int2 += 25 {
+				for _, str := range strs {
+					c := fizzbuzz.Config{Limit: limit, Int1: int1, Int2: int2, Str1: str, Str2: "buzz"}
+
+					want := []string{}
+					for i := 1; i <= limit; i++ {
+						var s string
+						if i%int1 == 0 {
+							s += c.Str1
+						}
+						if i%int2 == 0 {
+							s += c.Str2
+						}
+						if s == "" && i%int1 != 0 && i%int2 != 0 {
+							s = strconv.Itoa(i)
+						}
+						want = append(want, s)
+					}
+					wantJSON, err := json.Marshal(want)
+					if err != nil {
+						t.Fatal(err)
+					}
+					wantJSON = append(wantJSON, '\n')
+
+					var got bytes.Buffer
+					if _, err := c.WriteTo(&got); err != nil {
+						t.Fatal(err)
+					}
+					if !bytes.Equal(got.Bytes(), wantJSON) {
+						t.Fatalf("%+v:\ngot:  %s\nwant: %s", c, got.Bytes(), wantJSON)
+					}
+
+					// The summary matches the output
+					counts, err := fizzbuzz.Summary(c)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if counts.Bytes.Int64() != int64(got.Len()) {
+						t.Fatalf("%+v: got %d bytes, want %d", c, counts.Bytes, got.Len())
+					}
+					wantCounts := fizzbuzz.Counts{Bytes: counts.Bytes}
+					for i := 1; i <= limit; i++ {
+						switch {
+						case i%int1 == 0 && i%int2 == 0:
+							wantCounts.Both++
+						case i%int1 == 0:
+							wantCounts.Int1++
+						case i%int2 == 0:
+							wantCounts.Int2++
+						default:
+							wantCounts.Number++
+						}
+					}
+					if counts != wantCounts {
+						t.Fatalf("%+v:"+gotWant, c, counts, wantCounts)
+					}
+				}
+			}
+		}
+	}
+}
+
+func ExampleConfig_WriteRange() {
+	c := fizzbuzz.Default()
+	c.Limit = 10_000_000
+	c.WriteRange(os.Stdout, 1_000_000, 1_000_005)
+
+	v, _ := c.ValueAt(1_000_002)
+	fmt.Println(v)
+
+	// Output:
+	// ["fizz","1000001","fizzbuzz","1000003","fizz","buzz"]
+	// fizzbuzz
+}
+
+func ExampleConfig_Encode() {
+	c := fizzbuzz.Config{Limit: 6, Int1: 2, Int2: 3, Str1: "fizz,", Str2: "<buzz>"}
+	for _, f := range []fizzbuzz.Format{fizzbuzz.JSON, fizzbuzz.NDJSON, fizzbuzz.CSV, fizzbuzz.Text, fizzbuzz.XML} {
+		fmt.Println(f.MediaType())
+		c.Encode(os.Stdout, f, fizzbuzz.Strings, 1, c.Limit)
+	}
+
+	// Output:
+	// application/json
+	// ["1","fizz,","<buzz>","fizz,","5","fizz,<buzz>"]
+	// application/x-ndjson
+	// "1"
+	// "fizz,"
+	// "<buzz>"
+	// "fizz,"
+	// "5"
+	// "fizz,<buzz>"
+	// text/csv
+	// index,value,kind
+	// 1,1,number
+	// 2,"fizz,",int1
+	// 3,<buzz>,int2
+	// 4,"fizz,",int1
+	// 5,5,number
+	// 6,"fizz,<buzz>",both
+	// text/plain
+	// 1
+	// fizz,
+	// <buzz>
+	// fizz,
+	// 5
+	// fizz,<buzz>
+	// application/xml
+	// <?xml version="1.0" encoding="UTF-8"?>
+	// <fizzbuzz><value>1</value><value>fizz,</value><value>&lt;buzz&gt;</value><value>fizz,</value><value>5</value><value>fizz,&lt;buzz&gt;</value></fizzbuzz>
+}
+
+func ExampleConfig_Encode_binary() {
+	c := fizzbuzz.Config{Limit: 6, Int1: 2, Int2: 3, Str1: "a", Str2: "b"}
+	for _, f := range []fizzbuzz.Format{fizzbuzz.MsgPack, fizzbuzz.CBOR} {
+		var b bytes.Buffer
+		c.Encode(&b, f, fizzbuzz.Strings, 1, c.Limit)
+		fmt.Printf("%s: % x\n", f, b.Bytes())
+	}
+
+	c = fizzbuzz.Config{Limit: 1000, Int1: 7, Int2: 11, Str1: "a", Str2: "b"}
+	for _, f := range []fizzbuzz.Format{fizzbuzz.MsgPack, fizzbuzz.CBOR} {
+		var b bytes.Buffer
+		c.Encode(&b, f, fizzbuzz.Strings, 999, 1000)
+		fmt.Printf("%s: % x\n", f, b.Bytes())
+	}
+
+	// Output:
+	// msgpack: 96 01 a1 61 a1 62 a1 61 05 a2 61 62
+	// cbor: 9f 01 61 61 61 62 61 61 05 62 61 62 ff
+	// msgpack: 92 cd 03 e7 cd 03 e8
+	// cbor: 9f 19 03 e7 19 03 e8 ff
+}
+
+func ExampleSummary() {
+	c := fizzbuzz.Default()
+	c.Limit = math.MaxInt
+	counts, _ := fizzbuzz.Summary(c)
+	fmt.Printf("%+v\n", counts)
+
+	// Output:
+	// {Number:3074457345618258603 Int1:3074457345618258602 Int2:1537228672809129301 Both:1537228672809129301 Bytes:+116459008763123456536}
+}
+
+func ExampleShape() {
+	c := fizzbuzz.Default()
+	c.Limit = 6
+	c.Encode(os.Stdout, fizzbuzz.JSON, fizzbuzz.Objects, 5, 6)
+	c.Encode(os.Stdout, fizzbuzz.NDJSON, fizzbuzz.Tuples, 5, 6)
+
+	// Output:
+	// [{"n":5,"value":"5","kind":"number"},{"n":6,"value":"fizzbuzz","kind":"both"}]
+	// [5,"5","number"]
+	// [6,"fizzbuzz","both"]
+}
+
+// TestWriteRange checks that pages of values can be stitched together to get the whole Fizz buzz
+func TestWriteRange(t *testing.T) {
+	c := fizzbuzz.Config{Limit: 1000, Int1: 3, Int2: 7, Str1: "fizz", Str2: "buzz"}
+
+	var whole []string
+	var b bytes.Buffer
+	if _, err := c.WriteTo(&b); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(b.Bytes(), &whole); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, pageSize := range []int{1, 2, 20, 21, 42, 999, 1000, 1001} {
+		var stitched []string
+		for from := 1; from <= c.Limit; from += pageSize {
+			var page []string
+			b.Reset()
+			if _, err := c.WriteRange(&b, from, from+pageSize-1); err != nil {
+				t.Fatal(err)
+			}
+			if err := json.Unmarshal(b.Bytes(), &page); err != nil {
+				t.Fatal(err)
+			}
+			stitched = append(stitched, page...)
+		}
+		if fmt.Sprint(stitched) != fmt.Sprint(whole) {
+			t.Fatalf("page size %d:\ngot:  %v\nwant: %v", pageSize, stitched, whole)
+		}
+	}
+
+	for i, want := range whole {
+		if got, err := c.ValueAt(i + 1); err != nil {
+			t.Fatal(err)
+		} else if got != want {
+			t.Fatalf("ValueAt(%d):\ngot:  %s\nwant: %s", i+1, got, want)
+		}
+	}
+
+	// Out of range
+	b.Reset()
+	if _, err := c.WriteRange(&b, 1001, 2000); err != nil {
+		t.Fatal(err)
+	} else if b.String() != "[]\n" {
+		t.Fatalf("out of range: got %q", b.String())
+	}
+	for _, i := range []int{-1, 0, 1001} {
+		if _, err := c.ValueAt(i); !errors.Is(err, fizzbuzz.ErrInvalidInput) {
+			t.Fatalf("ValueAt(%d): got %v, want %v", i, err, fizzbuzz.ErrInvalidInput)
+		}
+	}
+}
+
+// TestReader checks that a Reader gives the output of WriteRange, from any offset
+func TestReader(t *testing.T) {
+	for _, c := range []fizzbuzz.RuleConfig{
+		{Limit: 1000, Rules: []fizzbuzz.Rule{{Divisor: 3, Str: "fizz"}, {Divisor: 7, Str: `"\`}}},
+		{Limit: 10, Rules: []fizzbuzz.Rule{{Divisor: 2, Str: "👌🏻"}, {Divisor: 4, Str: ""}, {Divisor: 2, Str: "a"}}},
+		{Limit: 100, Rules: []fizzbuzz.Rule{{Divisor: 1, Str: "a"}}},
+		{Limit: 150, Rules: nil},
+		{Limit: 0},
+	} {
+		for _, r := range [][2]int{{1, c.Limit}, {-5, 5}, {50, 120}, {99, 99}, {7, 3}} {
+			var want bytes.Buffer
+			if _, err := c.WriteRange(&want, r[0], r[1]); err != nil {
+				t.Fatal(err)
+			}
+			reader, err := c.NewReader(r[0], r[1])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if reader.Size() != int64(want.Len()) {
+				t.Fatalf("%+v %v: got size %d, want %d", c, r, reader.Size(), want.Len())
+			}
+			got, err := io.ReadAll(reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want.Bytes()) {
+				t.Fatalf("%+v %v:\ngot:  %q\nwant: %q", c, r, got, want.Bytes())
+			}
+			for off := 0; off < want.Len(); off++ {
+				p := make([]byte, 5)
+				n, err := reader.ReadAt(p, int64(off))
+				if n < len(p) && err != io.EOF || n == len(p) && err != nil {
+					t.Fatal(err)
+				}
+				if wantP := want.Bytes()[off:]; !bytes.Equal(p[:n], wantP[:n]) || n < len(p) && n != len(wantP) {
+					t.Fatalf("%+v %v offset %d:\ngot:  %q\nwant: %q", c, r, off, p[:n], wantP)
+				}
+			}
+		}
+	}
+
+	c := fizzbuzz.Default()
+	c.Limit = math.MaxInt
+	if _, err := c.NewReader(1, c.Limit); !errors.Is(err, fizzbuzz.ErrTooLarge) {
+		t.Fatalf("got %v, want %v", err, fizzbuzz.ErrTooLarge)
+	}
+	if reader, err := c.NewReader(c.Limit-1, c.Limit); err != nil {
+		t.Fatal(err)
+	} else if got, err := io.ReadAll(reader); err != nil {
+		t.Fatal(err)
+	} else if string(got) != `["fizzbuzz","9223372036854775807"]`+"\n" {
+		t.Fatalf("got %s", got)
+	}
+}
+
+// cancelWriter cancels its context once it has written more than max bytes
+type cancelWriter struct {
+	bytes.Buffer
+	max    int
+	cancel context.CancelFunc
+}
+
+func (w *cancelWriter) Write(p []byte) (int, error) {
+	if w.Len() > w.max {
+		w.cancel()
+	}
+	return w.Buffer.Write(p)
+}
+
+// TestWriteToContext checks that the writing stops once the context is done, and that the progress is reported
+func TestWriteToContext(t *testing.T) {
+	c := fizzbuzz.Default()
+	c.Limit = 1_000_000
+	for _, f := range []fizzbuzz.Format{fizzbuzz.JSON, fizzbuzz.CSV} {
+		ctx, cancel := context.WithCancel(context.Background())
+		w := &cancelWriter{max: 100_000, cancel: cancel}
+		var values int
+		var written int64
+		n, err := c.EncodeContext(ctx, w, f, fizzbuzz.Strings, 1, c.Limit, func(v int, b int64) {
+			if v <= values || b <= written {
+				t.Fatalf("%s: progress went from %d values and %d bytes to %d and %d", f, values, written, v, b)
+			}
+			values, written = v, b
+		})
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("%s: got %v, want %v", f, err, context.Canceled)
+		}
+		if n != int64(w.Len()) || n != written {
+			t.Fatalf("%s: got %d bytes written, %d bytes received and %d bytes reported", f, n, w.Len(), written)
+		}
+		if n > 200_000 || values >= c.Limit {
+			t.Fatalf("%s: the writing didn't stop early enough: %d bytes and %d values", f, n, values)
+		}
+	}
+
+	var b bytes.Buffer
+	var values int
+	var written int64
+	n, err := c.WriteToContext(context.Background(), &b, func(v int, n int64) { values, written = v, n })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if values != c.Limit || written != n || n != int64(b.Len()) {
+		t.Fatalf("got %d values and %d bytes reported, want %d values and %d bytes", values, written, c.Limit, n)
+	}
+}
+
+// TestEncodeTooLarge checks that the ranges a MessagePack array can't hold are rejected before writing anything
+func TestEncodeTooLarge(t *testing.T) {
+	c := fizzbuzz.Default()
+	c.Limit = math.MaxUint32 + 1
+	var b bytes.Buffer
+	if n, err := c.Encode(&b, fizzbuzz.MsgPack, fizzbuzz.Strings, 1, c.Limit); !errors.Is(err, fizzbuzz.ErrTooLarge) {
+		t.Fatalf("got %v, want %v", err, fizzbuzz.ErrTooLarge)
+	} else if n != 0 || b.Len() != 0 {
+		t.Fatalf("got %d bytes written", b.Len())
+	}
+}
+
+// TestEncodeInvalid checks that an unknown format or shape is rejected before writing anything
+func TestEncodeInvalid(t *testing.T) {
+	c := fizzbuzz.Default()
+	for _, tt := range []struct {
+		f fizzbuzz.Format
+		s fizzbuzz.Shape
+	}{
+		{-1, fizzbuzz.Strings},
+		{99, fizzbuzz.Strings},
+		{fizzbuzz.JSON, -1},
+		{fizzbuzz.JSON, 9},
+		{fizzbuzz.NDJSON, 9},
+		{fizzbuzz.CSV, 9},
+	} {
+		var b bytes.Buffer
+		if _, err := c.Encode(&b, tt.f, tt.s, 1, c.Limit); !errors.Is(err, fizzbuzz.ErrInvalidInput) {
+			t.Fatalf("%s %s: got %v, want %v", tt.f, tt.s, err, fizzbuzz.ErrInvalidInput)
+		} else if b.Len() != 0 {
+			t.Fatalf("%s %s: got %d bytes written", tt.f, tt.s, b.Len())
+		}
+	}
+}
+
+const gotWant = "\ngot:  %+v\nwant: %+v"
+
 // BenchmarkWriteTo benchmarks WriteTo with a default config and a limit of n
 func BenchmarkWriteTo(b *testing.B) {
 	c := fizzbuzz.Default()
@@ -38,3 +417,29 @@ func BenchmarkWriteTo(b *testing.B) {
 		})
 	}
 }
+
+// TestString checks that the names and media types of the out-of-range values don't panic
+func TestString(t *testing.T) {
+	for _, tt := range []struct {
+		v    fmt.Stringer
+		want string
+	}{
+		{fizzbuzz.KindInt2, "int2"},
+		{fizzbuzz.Kind(-1), "Kind(-1)"},
+		{fizzbuzz.CSV, "csv"},
+		{fizzbuzz.Format(99), "Format(99)"},
+		{fizzbuzz.Shape(99), "Shape(99)"},
+	} {
+		if got := tt.v.String(); got != tt.want {
+			t.Errorf("got %q, want %q", got, tt.want)
+		}
+	}
+	for _, f := range []fizzbuzz.Format{-1, 99} {
+		if got := f.MediaType(); got != "application/octet-stream" {
+			t.Errorf("%s: got media type %q", f, got)
+		}
+		if got := f.ContentType(); got != "application/octet-stream" {
+			t.Errorf("%s: got content type %q", f, got)
+		}
+	}
+}
@@ -0,0 +1,367 @@
+package fizzbuzz
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Kind tells what a Fizz buzz value is made of.
+// The kinds form a bit set: KindBoth is KindInt1|KindInt2.
+type Kind int
+
+const (
+	KindNumber Kind = iota // KindNumber is a number not divisible by Int1 or Int2
+	KindInt1               // KindInt1 is a number only divisible by Int1, replaced by Str1
+	KindInt2               // KindInt2 is a number only divisible by Int2, replaced by Str2
+	KindBoth               // KindBoth is a number divisible by Int1 and Int2, replaced by Str1+Str2
+)
+
+var kindNames = [...]string{"number", "int1", "int2", "both"}
+
+func (k Kind) String() string {
+	if k < 0 || int(k) >= len(kindNames) {
+		return "Kind(" + strconv.Itoa(int(k)) + ")"
+	}
+	return kindNames[k]
+}
+
+// Format is an output format of the Fizz buzz values.
+type Format int
+
+const (
+	JSON    Format = iota // JSON is a JSON array of strings, as written by WriteTo
+	NDJSON                // NDJSON is a JSON string per line (newline-delimited JSON)
+	CSV                   // CSV has the index, value and kind columns, after a header line
+	Text                  // Text is a value per line, without any escaping
+	XML                   // XML is a list of value elements
+	MsgPack               // MsgPack is a MessagePack array of integers (the numbers) and strings (the replaced values), of at most math.MaxUint32 values
+	CBOR                  // CBOR is a CBOR indefinite-length array of integers (the numbers) and strings (the replaced values)
+)
+
+// Formats lists all the formats, by order of preference.
+var Formats = []Format{JSON, NDJSON, CSV, Text, XML, MsgPack, CBOR}
+
+var formats = [...]struct {
+	name, mediaType string
+	binary          bool
+}{
+	JSON:    {"json", "application/json", false},
+	NDJSON:  {"ndjson", "application/x-ndjson", false},
+	CSV:     {"csv", "text/csv", false},
+	Text:    {"text", "text/plain", false},
+	XML:     {"xml", "application/xml", false},
+	MsgPack: {"msgpack", "application/msgpack", true},
+	CBOR:    {"cbor", "application/cbor", true},
+}
+
+// valid reports whether f is one of the Formats.
+func (f Format) valid() bool {
+	return f >= 0 && int(f) < len(formats)
+}
+
+func (f Format) String() string {
+	if !f.valid() {
+		return "Format(" + strconv.Itoa(int(f)) + ")"
+	}
+	return formats[f].name
+}
+
+// MediaType returns the media type of the format, without parameters.
+// It is application/octet-stream for an unknown format.
+func (f Format) MediaType() string {
+	if !f.valid() {
+		return "application/octet-stream"
+	}
+	return formats[f].mediaType
+}
+
+// ContentType returns the value of the Content-Type HTTP header of the format.
+func (f Format) ContentType() string {
+	if !f.valid() || formats[f].binary {
+		return f.MediaType()
+	}
+	return formats[f].mediaType + "; charset=utf-8"
+}
+
+// MarshalText implements the encoding.TextMarshaler interface.
+func (f Format) MarshalText() ([]byte, error) {
+	return []byte(f.String()), nil
+}
+
+// UnmarshalText implements the encoding.TextUnmarshaler interface.
+func (f *Format) UnmarshalText(text []byte) error {
+	for format := range formats {
+		if formats[format].name == string(text) {
+			*f = Format(format)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown format %q", text)
+}
+
+// encoder describes how a format writes the values, each one being encoded independently.
+type encoder struct {
+	begin    func(buf []byte, count int) []byte // begin appends what comes before the count values, if not nil
+	end      []byte                             // end is written after the last value
+	sep      []byte                             // sep is written between the values
+	empty    []byte                             // empty is written instead of begin and end when there is no value
+	maxCount uint64                             // maxCount is the maximum number of values, 0 meaning no maximum
+	escape   func(string) []byte                // escape encodes a string once, before writing the values
+	// value appends the value at position i, v being the digits of i or the escaped string
+	value func(buf []byte, i int, kind Kind, v []byte) []byte
+}
+
+// fixed returns an encoder.begin function that always appends s.
+func fixed(s string) func([]byte, int) []byte {
+	return func(buf []byte, _ int) []byte {
+		return append(buf, s...)
+	}
+}
+
+// csvEscape quotes a CSV field if needed, like encoding/csv does.
+func csvEscape(s string) []byte {
+	if s == "" || !strings.ContainsAny(s, "\",\r\n") && s[0] != ' ' && s[0] != '\t' {
+		return []byte(s)
+	}
+	return []byte(`"` + strings.ReplaceAll(s, `"`, `""`) + `"`)
+}
+
+// xmlEscape escapes a string to be used as XML character data.
+func xmlEscape(s string) []byte {
+	var b bytes.Buffer
+	xml.EscapeText(&b, []byte(s)) // it is safe to ignore the error because a bytes.Buffer cannot cause one
+	return b.Bytes()
+}
+
+var encoders = [...]encoder{
+	CSV: {
+		begin:  fixed("index,value,kind\n"),
+		empty:  []byte("index,value,kind\n"),
+		escape: csvEscape,
+		value: func(buf []byte, i int, kind Kind, v []byte) []byte {
+			buf = strconv.AppendInt(buf, int64(i), 10)
+			buf = append(buf, ',')
+			buf = append(buf, v...)
+			buf = append(buf, ',')
+			buf = append(buf, kindNames[kind]...)
+			return append(buf, '\n')
+		},
+	},
+	Text: {
+		escape: func(s string) []byte { return []byte(s) },
+		value: func(buf []byte, i int, kind Kind, v []byte) []byte {
+			buf = append(buf, v...)
+			return append(buf, '\n')
+		},
+	},
+	XML: {
+		begin:  fixed(xml.Header + "<fizzbuzz>"),
+		end:    []byte("</fizzbuzz>\n"),
+		empty:  []byte(xml.Header + "<fizzbuzz></fizzbuzz>\n"),
+		escape: xmlEscape,
+		value: func(buf []byte, i int, kind Kind, v []byte) []byte {
+			buf = append(buf, "<value>"...)
+			buf = append(buf, v...)
+			return append(buf, "</value>"...)
+		},
+	},
+	MsgPack: {
+		// MessagePack has no indefinite-length arrays, but the number of values is known in advance.
+		// The largest array (array 32) holds math.MaxUint32 values, so Encode rejects the bigger ranges with an ErrTooLarge.
+		begin: func(buf []byte, count int) []byte {
+			return msgpackArray(buf, uint64(count))
+		},
+		empty:    []byte{0x90},
+		maxCount: math.MaxUint32,
+		escape: func(s string) []byte {
+			return msgpackString(nil, strings.ToValidUTF8(s, "\uFFFD"))
+		},
+		value: func(buf []byte, i int, kind Kind, v []byte) []byte {
+			if kind != KindNumber {
+				return append(buf, v...)
+			}
+			return msgpackUint(buf, uint64(i))
+		},
+	},
+	CBOR: {
+		begin: fixed("\x9f"), // indefinite-length array
+		end:   []byte{0xff},  // break
+		empty: []byte{0x9f, 0xff},
+		escape: func(s string) []byte {
+			s = strings.ToValidUTF8(s, "\uFFFD")
+			return append(cborHeader(nil, 3, uint64(len(s))), s...) // major type 3: text string
+		},
+		value: func(buf []byte, i int, kind Kind, v []byte) []byte {
+			if kind != KindNumber {
+				return append(buf, v...)
+			}
+			return cborHeader(buf, 0, uint64(i)) // major type 0: unsigned integer
+		},
+	},
+}
+
+// msgpackArray appends the header of a MessagePack array of n elements.
+func msgpackArray(buf []byte, n uint64) []byte {
+	switch {
+	case n <= 15:
+		return append(buf, 0x90|byte(n)) // fixarray
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(buf, 0xdc), uint16(n)) // array 16
+	default:
+		return binary.BigEndian.AppendUint32(append(buf, 0xdd), uint32(n)) // array 32
+	}
+}
+
+// msgpackString appends a MessagePack string.
+func msgpackString(buf []byte, s string) []byte {
+	switch n := uint64(len(s)); {
+	case n <= 31:
+		buf = append(buf, 0xa0|byte(n)) // fixstr
+	case n <= math.MaxUint8:
+		buf = append(buf, 0xd9, byte(n)) // str 8
+	case n <= math.MaxUint16:
+		buf = binary.BigEndian.AppendUint16(append(buf, 0xda), uint16(n)) // str 16
+	default:
+		buf = binary.BigEndian.AppendUint32(append(buf, 0xdb), uint32(n)) // str 32
+	}
+	return append(buf, s...)
+}
+
+// msgpackUint appends a MessagePack unsigned integer.
+func msgpackUint(buf []byte, n uint64) []byte {
+	switch {
+	case n <= 0x7f:
+		return append(buf, byte(n)) // positive fixint
+	case n <= math.MaxUint8:
+		return append(buf, 0xcc, byte(n)) // uint 8
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(buf, 0xcd), uint16(n)) // uint 16
+	case n <= math.MaxUint32:
+		return binary.BigEndian.AppendUint32(append(buf, 0xce), uint32(n)) // uint 32
+	default:
+		return binary.BigEndian.AppendUint64(append(buf, 0xcf), n) // uint 64
+	}
+}
+
+// cborHeader appends the header of a CBOR data item of the major type and argument n.
+func cborHeader(buf []byte, major byte, n uint64) []byte {
+	major <<= 5
+	switch {
+	case n < 24:
+		return append(buf, major|byte(n))
+	case n <= math.MaxUint8:
+		return append(buf, major|24, byte(n))
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(buf, major|25), uint16(n))
+	case n <= math.MaxUint32:
+		return binary.BigEndian.AppendUint32(append(buf, major|26), uint32(n))
+	default:
+		return binary.BigEndian.AppendUint64(append(buf, major|27), n)
+	}
+}
+
+// Encode writes the values from position from to position to (both included, 1 being the first) in the format f,
+// the values having the shape s in the JSON and NDJSON formats. The range is clamped to the values of the Fizz buzz.
+//
+// The JSON format with the Strings shape is the output of WriteRange.
+// Attempting to write a Fizz buzz with negative or zero divisors, in an unknown format or shape, or with a shape
+// other than Strings in other formats causes Encode to return an ErrInvalidInput, and attempting to write more values than the
+// format can hold causes it to return an ErrTooLarge. Any other errors reported may be due to w.Write.
+func (c *Config) Encode(w io.Writer, f Format, s Shape, from, to int) (n int64, err error) {
+	return c.EncodeContext(context.Background(), w, f, s, from, to, nil)
+}
+
+// EncodeContext is like Encode but stops with the context error as soon as ctx is done.
+// The context is checked before writing each chunk of values, and progress (if not nil) is called after.
+func (c *Config) EncodeContext(ctx context.Context, w io.Writer, f Format, s Shape, from, to int, progress Progress) (n int64, err error) {
+	if !f.valid() {
+		return 0, fmt.Errorf("%w: unknown format %s", ErrInvalidInput, f)
+	}
+	if !s.valid() {
+		return 0, fmt.Errorf("%w: unknown shape %s", ErrInvalidInput, s)
+	}
+	var enc encoder
+	switch {
+	case f == JSON && s == Strings:
+		return c.WriteRangeContext(ctx, w, from, to, progress)
+	case f == JSON || f == NDJSON:
+		enc = jsonEncoder(f, s)
+	case s != Strings:
+		return 0, fmt.Errorf("%w: the %s format doesn't support the %s shape", ErrInvalidInput, f, s)
+	default:
+		enc = encoders[f]
+	}
+	if err := c.validate(); err != nil {
+		return 0, err
+	}
+
+	rc := c.Rules()
+	from, to = rc.clamp(from, to)
+	if from <= to && enc.maxCount > 0 && uint64(to-from+1) > enc.maxCount {
+		return 0, fmt.Errorf("%w: %s cannot hold more than %d values", ErrTooLarge, f, enc.maxCount)
+	}
+
+	cw := chunkWriter{ctx: ctx, w: w, progress: progress}
+	defer func() { n, err = cw.n, cw.err }()
+
+	if from > to {
+		cw.write(enc.empty, 0)
+		return
+	}
+
+	// Encode the strings once, the strings of KindBoth being the concatenation of the two others
+	strs := [...][]byte{
+		KindInt1: enc.escape(c.Str1),
+		KindInt2: enc.escape(c.Str2),
+		KindBoth: enc.escape(c.Str1 + c.Str2),
+	}
+
+	// buf is used to accumulate the bytes of the values
+	var buf []byte
+	if enc.begin != nil {
+		buf = enc.begin(buf, to-from+1)
+	}
+
+	// intBuf is a buffer big enough to hold math.MaxInt (9223372036854775807), used to format an int
+	intBuf := make([]byte, 0, 19)
+
+	// Iterate over the Fizz buzz values, done being the position of the last value appended
+	for done := from - 1; done < to; {
+		if done >= from {
+			buf = append(buf, enc.sep...)
+		}
+		done++
+		kind := KindNumber
+		if done%c.Int1 == 0 {
+			kind |= KindInt1
+		}
+		if done%c.Int2 == 0 {
+			kind |= KindInt2
+		}
+		if kind == KindNumber {
+			buf = enc.value(buf, done, kind, strconv.AppendInt(intBuf, int64(done), 10))
+		} else {
+			buf = enc.value(buf, done, kind, strs[kind])
+		}
+
+		// Write the buffer once it is big enough
+		if len(buf) >= chunkSize {
+			if !cw.write(buf, done-from+1) {
+				return
+			}
+			// Truncate the slice while keeping the underlying storage intact to avoid unnecessary memory allocations
+			buf = buf[:0]
+		}
+	}
+
+	buf = append(buf, enc.end...)
+	cw.write(buf, to-from+1)
+	return
+}
@@ -2,6 +2,9 @@ module github.com/xpetit/fizzbuzz/v5
 
 go 1.20
 
-require github.com/mattn/go-sqlite3 v1.14.17
+require (
+	github.com/lib/pq v1.10.9
+	github.com/mattn/go-sqlite3 v1.14.17
+)
 
 require golang.org/x/exp v0.0.0-20230801115018-d63ba01acd4b
@@ -1,20 +1,32 @@
 package handlers
 
 import (
+	"context"
+	"crypto/subtle"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"hash/fnv"
 	"log"
 	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/exp/slices"
 
 	"github.com/xpetit/fizzbuzz/v5"
+	"github.com/xpetit/fizzbuzz/v5/stats"
 )
 
+// Stats is the part of stats.ContextService used by the handlers, which bind the calls to the requests.
+// Use stats.WithContext to adapt a stats.Service.
 type Stats interface {
-	Increment(cfg fizzbuzz.Config) error
-	MostFrequent() (count int, cfg fizzbuzz.Config, err error)
+	IncrementContext(ctx context.Context, cfg fizzbuzz.Config) error
+	MostFrequentContext(ctx context.Context) (count int, cfg fizzbuzz.Config, err error)
+	MostFrequentInContext(ctx context.Context, w stats.Window) (count int, cfg fizzbuzz.Config, err error)
+	TopNContext(ctx context.Context, n int, f stats.Filter) ([]stats.Entry, error)
 }
 
 type handlers struct {
@@ -38,8 +50,97 @@ func jsonErr(rw http.ResponseWriter, message string, code int) {
 	}
 }
 
+// statsErr responds the error of a stats query: the service is unavailable if its circuit breaker is open.
+func statsErr(rw http.ResponseWriter, err error) {
+	code := http.StatusInternalServerError
+	if errors.Is(err, stats.ErrUnavailable) {
+		code = http.StatusServiceUnavailable
+	}
+	jsonErr(rw, err.Error(), code)
+}
+
+// parseConfig parses the Fizz buzz config from the query values, with default values.
+// The other accepted query parameters are either parsed into the ints, or listed in others.
+func parseConfig(values url.Values, ints map[string]*int, others ...string) (fizzbuzz.Config, error) {
+	c := fizzbuzz.Default()
+	intValues := map[string]*int{
+		"int1":  &c.Int1,
+		"int2":  &c.Int2,
+		"limit": &c.Limit,
+	}
+	for key, target := range ints {
+		intValues[key] = target
+	}
+	strValues := map[string]*string{
+		"str1": &c.Str1,
+		"str2": &c.Str2,
+	}
+
+	for key := range values {
+		_, isInt := intValues[key]
+		_, isStr := strValues[key]
+		if !isInt && !isStr && !slices.Contains(others, key) {
+			return c, errors.New("unknown query parameter: " + key)
+		}
+	}
+
+	for key, target := range intValues {
+		if values.Has(key) {
+			i, err := strconv.Atoi(values.Get(key))
+			if err != nil {
+				err := err.(*strconv.NumError)
+				return c, fmt.Errorf("parsing %s %q: %s", key, err.Num, err.Err)
+			}
+			*target = i
+		}
+	}
+	for key, target := range strValues {
+		if values.Has(key) {
+			*target = values.Get(key)
+		}
+	}
+	return c, nil
+}
+
+// links returns the value of the RFC 8288 Link header pointing to the first, previous, next and last pages.
+// The pages have the same size as the current one, the last being the last one reachable by following the next ones.
+func links(u *url.URL, values url.Values, total, offset, count int) string {
+	link := func(rel string, offset int) string {
+		query := url.Values{}
+		for key, v := range values {
+			query[key] = v
+		}
+		query.Set("offset", strconv.Itoa(offset))
+		query.Set("count", strconv.Itoa(count))
+		return fmt.Sprintf(`<%s?%s>; rel="%s"`, u.Path, query.Encode(), rel)
+	}
+
+	header := []string{link("first", 0)}
+	if offset > 0 {
+		prev := offset - count
+		if prev < 0 {
+			prev = 0
+		}
+		header = append(header, link("prev", prev))
+	}
+	if offset < total && count < total-offset {
+		header = append(header, link("next", offset+count))
+	}
+	if offset < total {
+		header = append(header, link("last", offset+(total-offset-1)/count*count))
+	}
+	return strings.Join(header, ", ")
+}
+
 // Handle is an HTTP handler that answers with a JSON array containing the Fizz buzz values.
 // It accepts optional URL query parameters to change the default config.
+//
+// The values can be paged with the offset (number of values to skip) and count (maximum number of values) query parameters.
+// The total number of values is sent in the X-Total-Count header and the links to the other pages in the Link header.
+//
+// The format is chosen with the format query parameter (json, ndjson, csv, text, xml, msgpack or cbor) or else with the Accept header.
+// In the JSON and NDJSON formats, the shape query parameter changes the values into objects or tuples with their position and kind.
+// For the JSON format of strings, unless the output is too large, its size is sent in the Content-Length header and byte ranges are supported.
 func (fb handlers) Handle(rw http.ResponseWriter, r *http.Request) {
 	rw.Header().Set("Content-Type", "application/json; charset=utf-8")
 
@@ -53,58 +154,258 @@ func (fb handlers) Handle(rw http.ResponseWriter, r *http.Request) {
 		jsonErr(rw, err.Error(), http.StatusBadRequest)
 		return
 	}
-	for key := range values {
-		switch key {
-		case "int1", "int2", "limit", "str1", "str2":
-		default:
-			jsonErr(rw, "unknown query parameter: "+key, http.StatusBadRequest)
+
+	// parse query parameters with default values
+	var offset, count int
+	c, err := parseConfig(values, map[string]*int{
+		"offset": &offset,
+		"count":  &count,
+	}, "format", "shape")
+	if err != nil {
+		jsonErr(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Compute the page of values to write, all of them by default
+	total := c.Limit
+	if total < 0 {
+		total = 0
+	}
+	paged := values.Has("offset") || values.Has("count")
+	if offset < 0 {
+		jsonErr(rw, "offset must not be negative", http.StatusBadRequest)
+		return
+	}
+	if !values.Has("count") {
+		count = total - offset
+		if count < 1 {
+			count = 1
+		}
+	} else if count < 1 {
+		jsonErr(rw, "count must be strictly positive", http.StatusBadRequest)
+		return
+	}
+	from, to := 1, 0 // empty page
+	if offset < total {
+		from = offset + 1
+		to = total
+		if count < total-offset {
+			to = offset + count
+		}
+	}
+
+	// Choose the format, from the query or from the Accept header
+	format := fizzbuzz.JSON
+	if values.Has("format") {
+		if err := format.UnmarshalText([]byte(values.Get("format"))); err != nil {
+			jsonErr(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+	} else {
+		rw.Header().Set("Vary", "Accept")
+		var ok bool
+		if format, ok = negotiate(r.Header.Get("Accept")); !ok {
+			jsonErr(rw, "no acceptable format, available formats: "+mediaTypes(), http.StatusNotAcceptable)
 			return
 		}
 	}
 
-	// parse query parameters with default values
-	c := fizzbuzz.Default()
-	intValues := map[string]*int{
-		"int1":  &c.Int1,
-		"int2":  &c.Int2,
-		"limit": &c.Limit,
+	// Choose the shape of the values in the JSON and NDJSON formats
+	shape := fizzbuzz.Strings
+	if values.Has("shape") {
+		if err := shape.UnmarshalText([]byte(values.Get("shape"))); err != nil {
+			jsonErr(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
 	}
-	for key, target := range intValues {
-		if values.Has(key) {
-			i, err := strconv.Atoi(values.Get(key))
-			if err != nil {
-				err := err.(*strconv.NumError)
-				jsonErr(rw, fmt.Sprintf("parsing %s %q: %s", key, err.Num, err.Err), http.StatusBadRequest)
-				return
-			}
-			*target = i
+
+	// The layout of the JSON output is known in advance, unless it is too large
+	var reader *fizzbuzz.Reader
+	if format == fizzbuzz.JSON && shape == fizzbuzz.Strings {
+		reader, err = c.NewReader(from, to)
+		if errors.Is(err, fizzbuzz.ErrInvalidInput) {
+			jsonErr(rw, err.Error(), http.StatusBadRequest)
+			return
 		}
 	}
 
-	strValues := map[string]*string{
-		"str1": &c.Str1,
-		"str2": &c.Str2,
+	rw.Header().Set("Content-Type", format.ContentType())
+	rw.Header().Set("X-Total-Count", strconv.Itoa(total))
+	if paged {
+		rw.Header().Set("Link", links(r.URL, values, total, offset, count))
 	}
-	for key, target := range strValues {
-		if values.Has(key) {
-			*target = values.Get(key)
+
+	if reader != nil {
+		rw.Header().Set("Accept-Ranges", "bytes")
+		rw.Header().Set("ETag", etag(c, from, to))
+		if r.Header.Get("Range") != "" {
+			// Let net/http handle the byte ranges (including multipart/byteranges and If-Range)
+			sw := &statusWriter{ResponseWriter: rw}
+			http.ServeContent(sw, r, "", time.Time{}, reader)
+			// Only count the ranges that were served (not 304 Not Modified or 416 Range Not Satisfiable) entirely,
+			// and once per transfer: a full response, or the ranges starting at the first byte (not the resumptions)
+			if sw.status != http.StatusOK && sw.status != http.StatusPartialContent || sw.err != nil || r.Context().Err() != nil {
+				return
+			}
+			if sw.status == http.StatusPartialContent && !firstByteRequested(r.Header.Get("Range")) {
+				return
+			}
+			if err := fb.stats.IncrementContext(r.Context(), c); err != nil {
+				log.Println("stats.increment:", err)
+			}
+			return
 		}
+		rw.Header().Set("Content-Length", strconv.FormatInt(reader.Size(), 10))
 	}
 
-	// Write Fizz buzz and update the statistics in case of success
-	if _, err := c.WriteTo(rw); err != nil {
-		if errors.Is(err, fizzbuzz.ErrInvalidInput) {
+	// Write Fizz buzz until the client goes away and update the statistics in case of success
+	if _, err := c.EncodeContext(r.Context(), rw, format, shape, from, to, nil); err != nil {
+		if errors.Is(err, fizzbuzz.ErrInvalidInput) || errors.Is(err, fizzbuzz.ErrTooLarge) {
+			rw.Header().Set("Content-Type", "application/json; charset=utf-8")
+			rw.Header().Del("X-Total-Count")
+			rw.Header().Del("Link")
 			jsonErr(rw, err.Error(), http.StatusBadRequest)
+		} else if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+			log.Println("request canceled:", err)
 		} else {
 			log.Println("write error:", err)
 		}
-	} else if err := fb.stats.Increment(c); err != nil {
+	} else if err := fb.stats.IncrementContext(r.Context(), c); err != nil {
 		log.Println("stats.increment:", err)
 	}
 }
 
+// statusWriter records the status code of a response, and the first error writing its body.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	err    error
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	if err != nil && w.err == nil {
+		w.err = err
+	}
+	return n, err
+}
+
+// firstByteRequested reports whether one of the byte ranges of the Range header starts at the first byte.
+func firstByteRequested(header string) bool {
+	specs, ok := strings.CutPrefix(header, "bytes=")
+	if !ok {
+		return false
+	}
+	for _, spec := range strings.Split(specs, ",") {
+		first, _, _ := strings.Cut(strings.TrimSpace(spec), "-")
+		if n, err := strconv.ParseInt(first, 10, 64); err == nil && n == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// etag returns a strong entity tag identifying the output of a Fizz buzz, which is deterministic.
+func etag(c fizzbuzz.Config, from, to int) string {
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%d\x00%d\x00%d\x00%s\x00%s\x00%d\x00%d", c.Limit, c.Int1, c.Int2, c.Str1, c.Str2, from, to)
+	return fmt.Sprintf(`"%x"`, h.Sum64())
+}
+
+// HandleSummary is an HTTP handler that answers with a JSON object containing the number of Fizz buzz values of each kind
+// and the size in bytes of the JSON array. It accepts the same config query parameters as Handle.
+// The values are not generated, so it answers instantly even for the largest limits.
+func (fb handlers) HandleSummary(rw http.ResponseWriter, r *http.Request) {
+	rw.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+	if r.Method != http.MethodGet {
+		jsonErr(rw, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	values, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		jsonErr(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	c, err := parseConfig(values, nil)
+	if err != nil {
+		jsonErr(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	counts, err := fizzbuzz.Summary(c)
+	if err != nil {
+		jsonErr(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := json.NewEncoder(rw).Encode(struct {
+		Config fizzbuzz.Config `json:"config"`
+		Counts fizzbuzz.Counts `json:"counts"`
+	}{c, counts}); err != nil {
+		log.Println("write error:", err)
+	}
+}
+
+// parseWindow parses the time window of the stats from the query values: since and until are RFC 3339 times,
+// window is a duration ending at until (now by default). It returns false if there is no window.
+func parseWindow(values url.Values, now time.Time) (w stats.Window, ok bool, err error) {
+	for key := range values {
+		if key != "since" && key != "until" && key != "window" {
+			return w, false, errors.New("unknown query parameter: " + key)
+		}
+	}
+	if values.Has("since") && values.Has("window") {
+		return w, false, errors.New("since and window are mutually exclusive")
+	}
+	for key, target := range map[string]*time.Time{
+		"since": &w.Since,
+		"until": &w.Until,
+	} {
+		if values.Has(key) {
+			t, err := time.Parse(time.RFC3339, values.Get(key))
+			if err != nil {
+				return w, false, fmt.Errorf("parsing %s %q: not an RFC 3339 time", key, values.Get(key))
+			}
+			*target = t
+		}
+	}
+	if values.Has("window") {
+		d, err := time.ParseDuration(values.Get("window"))
+		if err != nil {
+			return w, false, fmt.Errorf("parsing window %q: not a duration", values.Get("window"))
+		}
+		if d <= 0 {
+			return w, false, errors.New("window must be strictly positive")
+		}
+		end := w.Until
+		if end.IsZero() {
+			end = now
+		}
+		w.Since = end.Add(-d)
+	}
+	if !w.Since.IsZero() && !w.Until.IsZero() && !w.Since.Before(w.Until) {
+		return w, false, errors.New("since must be before until")
+	}
+	return w, len(values) > 0, nil
+}
+
 // HandleStats is an HTTP handler that answers with a JSON object representing the most used Fizz buzz config.
 // If no previous call to fizzbuzz has been made, most_frequent.count is 0 and most_frequent.config doesn't exist.
+// If the stats are approximate, most_frequent.max_error is the maximum overestimation of the count.
+//
+// The hits can be restricted to a time window with the since and until (RFC 3339 times) query parameters,
+// or with the window query parameter: a duration (such as 1h) ending at until or else now.
 func (fb handlers) HandleStats(rw http.ResponseWriter, r *http.Request) {
 	rw.Header().Set("Content-Type", "application/json; charset=utf-8")
 
@@ -112,28 +413,193 @@ func (fb handlers) HandleStats(rw http.ResponseWriter, r *http.Request) {
 		jsonErr(rw, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
 		return
 	}
-	if r.URL.RawQuery != "" {
-		jsonErr(rw, "this endpoint takes no parameters", http.StatusBadRequest)
+
+	values, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		jsonErr(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w, windowed, err := parseWindow(values, time.Now())
+	if err != nil {
+		jsonErr(rw, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	count, cfg, err := fb.stats.MostFrequent()
+	var count int
+	var cfg fizzbuzz.Config
+	if windowed {
+		count, cfg, err = fb.stats.MostFrequentInContext(r.Context(), w)
+	} else {
+		count, cfg, err = fb.stats.MostFrequentContext(r.Context())
+	}
 	if err != nil {
 		log.Println("stats.mostfrequent:", err)
-		jsonErr(rw, err.Error(), http.StatusInternalServerError)
+		statsErr(rw, err)
 		return
 	}
 	var result struct {
 		MostFrequent struct {
-			Config *fizzbuzz.Config `json:"config,omitempty"`
-			Count  int              `json:"count"`
+			Config   *fizzbuzz.Config `json:"config,omitempty"`
+			Count    int              `json:"count"`
+			MaxError *int             `json:"max_error,omitempty"`
 		} `json:"most_frequent"`
 	}
 	if count > 0 {
 		result.MostFrequent.Count = count
 		result.MostFrequent.Config = &cfg
 	}
+	if a, ok := fb.stats.(stats.Approximate); ok && !windowed {
+		maxError := a.MaxError()
+		result.MostFrequent.MaxError = &maxError
+	}
+	if err := json.NewEncoder(rw).Encode(result); err != nil {
+		log.Println("write error:", err)
+	}
+}
+
+// maxTop is the maximum number of configs answered by HandleTop.
+const maxTop = 1000
+
+// HandleTop is an HTTP handler that answers with a JSON object containing the most used Fizz buzz configs, in the order of HandleStats.
+// The n query parameter is the number of configs (10 by default, at most 1000) and the others filter them:
+// min_limit and max_limit are the bounds (included) of the limit, int1 and int2 are the divisors,
+// str1_prefix and str2_prefix are the prefixes of the strings.
+func (fb handlers) HandleTop(rw http.ResponseWriter, r *http.Request) {
+	rw.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+	if r.Method != http.MethodGet {
+		jsonErr(rw, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	values, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		jsonErr(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	n := 10
+	var f stats.Filter
+	intValues := map[string]**int{
+		"min_limit": &f.MinLimit,
+		"max_limit": &f.MaxLimit,
+		"int1":      &f.Int1,
+		"int2":      &f.Int2,
+	}
+	strValues := map[string]*string{
+		"str1_prefix": &f.Str1Prefix,
+		"str2_prefix": &f.Str2Prefix,
+	}
+	for key := range values {
+		_, isInt := intValues[key]
+		_, isStr := strValues[key]
+		if !isInt && !isStr && key != "n" {
+			jsonErr(rw, "unknown query parameter: "+key, http.StatusBadRequest)
+			return
+		}
+	}
+	parseInt := func(key string) (int, bool) {
+		i, err := strconv.Atoi(values.Get(key))
+		if err != nil {
+			err := err.(*strconv.NumError)
+			jsonErr(rw, fmt.Sprintf("parsing %s %q: %s", key, err.Num, err.Err), http.StatusBadRequest)
+			return 0, false
+		}
+		return i, true
+	}
+	for key, target := range intValues {
+		if values.Has(key) {
+			i, ok := parseInt(key)
+			if !ok {
+				return
+			}
+			*target = &i
+		}
+	}
+	for key, target := range strValues {
+		*target = values.Get(key)
+	}
+	if values.Has("n") {
+		var ok bool
+		if n, ok = parseInt("n"); !ok {
+			return
+		}
+		if n < 1 || n > maxTop {
+			jsonErr(rw, fmt.Sprintf("n must be between 1 and %d", maxTop), http.StatusBadRequest)
+			return
+		}
+	}
+
+	top, err := fb.stats.TopNContext(r.Context(), n, f)
+	if err != nil {
+		log.Println("stats.topn:", err)
+		statsErr(rw, err)
+		return
+	}
+	if top == nil {
+		top = []stats.Entry{}
+	}
+	if err := json.NewEncoder(rw).Encode(struct {
+		Top []stats.Entry `json:"top"`
+	}{top}); err != nil {
+		log.Println("write error:", err)
+	}
+}
+
+// HandleReady is an HTTP handler that answers when the service is ready, with a JSON object containing
+// the state of the circuit breaker of the stats, if any. While it is open, the service stays ready:
+// the fizzbuzz requests are served and counted in memory, only the stats queries fail.
+func (fb handlers) HandleReady(rw http.ResponseWriter, r *http.Request) {
+	rw.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+	if r.Method != http.MethodGet {
+		jsonErr(rw, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	var result struct {
+		Breaker string `json:"stats_breaker,omitempty"`
+	}
+	if b, ok := fb.stats.(stats.Breaker); ok {
+		result.Breaker = b.State().String()
+	}
 	if err := json.NewEncoder(rw).Encode(result); err != nil {
 		log.Println("write error:", err)
 	}
 }
+
+// maxSync is the maximum size of the stats posted to HandleSync.
+const maxSync = 64 << 20
+
+// Sync returns an HTTP handler that merges the stats posted by a peer (written by stats.Mergeable.Export),
+// and answers with the stats that the peer doesn't have yet, so that both converge in one round trip.
+// The peer must send the shared secret in the "Authorization: Bearer <secret>" header, which must not be empty.
+func Sync(m stats.Mergeable, secret string) http.HandlerFunc {
+	if secret == "" {
+		panic("handlers.Sync: empty secret")
+	}
+	return func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+		if r.Method != http.MethodPost {
+			jsonErr(rw, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+
+		token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(secret)) != 1 {
+			rw.Header().Set("WWW-Authenticate", "Bearer")
+			jsonErr(rw, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+
+		versions, err := m.Merge(http.MaxBytesReader(rw, r.Body, maxSync))
+		if err != nil {
+			jsonErr(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := m.Export(rw, versions); err != nil {
+			log.Println("write error:", err)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package handlers
+
+import (
+	"mime"
+	"strconv"
+	"strings"
+
+	"github.com/xpetit/fizzbuzz/v5"
+)
+
+// quality returns the quality value given by the Accept header to the media type, 0 meaning "not acceptable".
+// The most specific media range matching the media type takes precedence (RFC 9110 section 12.5.1).
+func quality(accept, mediaType string) (q float64) {
+	typ, _, _ := strings.Cut(mediaType, "/")
+	precedence := 0
+	for _, mediaRange := range strings.Split(accept, ",") {
+		mr, params, err := mime.ParseMediaType(mediaRange)
+		if err != nil {
+			continue
+		}
+		var p int
+		switch mr {
+		case mediaType:
+			p = 3
+		case typ + "/*":
+			p = 2
+		case "*/*":
+			p = 1
+		default:
+			continue
+		}
+		if p < precedence {
+			continue
+		}
+		precedence = p
+		q = 1
+		if s, ok := params["q"]; ok {
+			if f, err := strconv.ParseFloat(s, 64); err == nil {
+				q = f
+			}
+		}
+	}
+	return
+}
+
+// negotiate returns the format preferred by the client according to the Accept header,
+// the order of fizzbuzz.Formats breaking ties. ok is false if no format is acceptable.
+func negotiate(accept string) (f fizzbuzz.Format, ok bool) {
+	if strings.TrimSpace(accept) == "" {
+		return fizzbuzz.JSON, true
+	}
+	var best float64
+	for _, format := range fizzbuzz.Formats {
+		if q := quality(accept, format.MediaType()); q > best {
+			best, f, ok = q, format, true
+		}
+	}
+	return
+}
+
+// mediaTypes returns the comma-separated list of the media types of the formats.
+func mediaTypes() string {
+	types := make([]string, len(fizzbuzz.Formats))
+	for i, f := range fizzbuzz.Formats {
+		types[i] = f.MediaType()
+	}
+	return strings.Join(types, ", ")
+}
@@ -0,0 +1,117 @@
+package fizzbuzz
+
+import (
+	"math"
+	"math/big"
+	"math/bits"
+)
+
+// pow10 holds the powers of 10 that fit in an int.
+var pow10 = func() (p [19]int) {
+	p[0] = 1
+	for i := 1; i < len(p); i++ {
+		p[i] = p[i-1] * 10
+	}
+	return
+}()
+
+// sum accumulates products of positive ints on 128 bits, which is enough for the size of any output.
+type sum struct {
+	hi, lo uint64
+}
+
+// add adds a*b to the sum.
+func (s *sum) add(a, b int) {
+	hi, lo := bits.Mul64(uint64(a), uint64(b))
+	var carry uint64
+	s.lo, carry = bits.Add64(s.lo, lo, 0)
+	s.hi, _ = bits.Add64(s.hi, hi, carry)
+}
+
+// int64 returns the sum, ok being false if it doesn't fit in an int64.
+func (s *sum) int64() (n int64, ok bool) {
+	return int64(s.lo), s.hi == 0 && s.lo <= math.MaxInt64
+}
+
+// big returns the sum as a big.Int.
+func (s *sum) big() *big.Int {
+	n := new(big.Int).SetUint64(s.hi)
+	n.Lsh(n, 64)
+	return n.Or(n, new(big.Int).SetUint64(s.lo))
+}
+
+// plainDivisors returns the divisors that matter to know if a number is replaced by a rule:
+// the divisors that are multiples of another one are removed, as well as the duplicates.
+func plainDivisors(rules []Rule) (divisors []int) {
+	for i, r := range rules {
+		redundant := false
+		for j, other := range rules {
+			// In case of duplicates, keep the first one
+			if r.Divisor%other.Divisor == 0 && (r.Divisor != other.Divisor || j < i) {
+				redundant = true
+				break
+			}
+		}
+		if !redundant {
+			divisors = append(divisors, r.Divisor)
+		}
+	}
+	return
+}
+
+// countPlain returns the number of positions between 1 and n that are not divisible by any of the divisors.
+//
+// It uses the inclusion–exclusion principle: n - Σ n/a + Σ n/lcm(a,b) - Σ n/lcm(a,b,c) + ...
+// The terms whose LCM is greater than n are zero, so they are skipped along with the ones derived from them.
+func countPlain(divisors []int, n int) int {
+	if n < 1 {
+		return 0
+	}
+	// count returns the sum of the terms of the subsets of divisors, combined with the LCM l
+	var count func(divisors []int, l int) int
+	count = func(divisors []int, l int) int {
+		total := n / l
+		for i, d := range divisors {
+			if m := lcm(l, d, n); m != 0 {
+				total -= count(divisors[i+1:], m)
+			}
+		}
+		return total
+	}
+	return count(divisors, 1)
+}
+
+// valuesSize returns the size of the JSON strings of the values from position from to position to (both included),
+// each one followed by a comma. lens holds the size of the JSON-encoded strings of the rules, without quotes.
+func (c *RuleConfig) valuesSize(lens, divisors []int, from, to int) (s sum) {
+	if from > to {
+		return
+	}
+
+	// Two quotes and a comma for each value
+	s.add(3, to-from+1)
+
+	// The strings of the rules
+	for j, r := range c.Rules {
+		s.add(lens[j], to/r.Divisor-(from-1)/r.Divisor)
+	}
+
+	// The digits of the numbers, grouped by number of digits
+	for d := range pow10 {
+		lo, hi := pow10[d], math.MaxInt
+		if d+1 < len(pow10) {
+			hi = pow10[d+1] - 1
+		}
+		if lo < from {
+			lo = from
+		}
+		if hi > to {
+			hi = to
+		}
+		if lo <= hi {
+			s.add(d+1, countPlain(divisors, hi)-countPlain(divisors, lo-1))
+		}
+	}
+
+	return
+}
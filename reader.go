@@ -0,0 +1,157 @@
+package fizzbuzz
+
+import (
+	"errors"
+	"io"
+	"math"
+	"sort"
+)
+
+// ErrTooLarge is returned when the output is too large for the chosen format, or for NewReader when it doesn't fit in math.MaxInt64 bytes.
+var ErrTooLarge = errors.New("output too large")
+
+// Reader reads the JSON output of WriteRange, generating it on the fly from any offset without producing what comes before.
+// It implements io.ReadSeeker and io.ReaderAt, so that it can be served with http.ServeContent.
+type Reader struct {
+	c        RuleConfig
+	lens     []int // lens holds the size of the JSON-encoded strings of the rules, without quotes
+	divisors []int // divisors are the divisors of the rules that matter to find numbers
+	from, to int
+	size     int64
+	off      int64
+}
+
+// NewReader returns a Reader of the output of c.WriteRange(w, from, to).
+//
+// It returns an ErrInvalidInput if the config is invalid, and an ErrTooLarge if the output is too large.
+func (c *Config) NewReader(from, to int) (*Reader, error) {
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+	rc := c.Rules()
+	return rc.NewReader(from, to)
+}
+
+// NewReader returns a Reader of the output of c.WriteRange(w, from, to).
+//
+// It returns an ErrInvalidInput if the config is invalid, and an ErrTooLarge if the output is too large.
+func (c *RuleConfig) NewReader(from, to int) (*Reader, error) {
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+	r := &Reader{
+		c:        *c,
+		lens:     make([]int, len(c.Rules)),
+		divisors: plainDivisors(c.Rules),
+	}
+	r.from, r.to = c.clamp(from, to)
+	if r.from > r.to {
+		r.size = int64(len(empty))
+		return r, nil
+	}
+	for i, rule := range c.Rules {
+		r.lens[i] = len(marshalJSON(rule.Str)) - 2
+	}
+	s := c.valuesSize(r.lens, r.divisors, r.from, r.to)
+	size, ok := s.int64()
+	if !ok || size > math.MaxInt64-2 {
+		return nil, ErrTooLarge
+	}
+	r.size = 1 + size + 1 // the opening bracket, the values (the last comma being replaced by the closing bracket), the newline
+	return r, nil
+}
+
+// Size returns the size of the output in bytes.
+func (r *Reader) Size() int64 {
+	return r.size
+}
+
+// offset returns the offset in the output of the value at position i, between r.from and r.to.
+func (r *Reader) offset(i int) int64 {
+	s := r.c.valuesSize(r.lens, r.divisors, r.from, i-1)
+	size, _ := s.int64() // cannot overflow because it is smaller than r.size
+	return 1 + size
+}
+
+// window is a writer that discards the first skip bytes, then copies the rest into p until it is full.
+type window struct {
+	p    []byte
+	n    int
+	skip int64
+}
+
+// errFull is returned by window when p is full, in order to stop the writing.
+var errFull = errors.New("full")
+
+func (w *window) Write(b []byte) (int, error) {
+	if w.skip >= int64(len(b)) {
+		w.skip -= int64(len(b))
+		return len(b), nil
+	}
+	w.n += copy(w.p[w.n:], b[w.skip:])
+	w.skip = 0
+	if w.n == len(w.p) {
+		return len(b), errFull
+	}
+	return len(b), nil
+}
+
+// ReadAt implements the io.ReaderAt interface.
+func (r *Reader) ReadAt(p []byte, off int64) (n int, err error) {
+	if off < 0 {
+		return 0, errors.New("fizzbuzz.Reader.ReadAt: negative offset")
+	}
+	if off >= r.size {
+		return 0, io.EOF
+	}
+
+	// Find the value containing the offset, the output of WriteRange starting at this value
+	// is the opening bracket followed by the rest of the output
+	from, skip := r.from, off
+	if off > 0 && r.from <= r.to {
+		from += sort.Search(r.to-r.from, func(i int) bool {
+			return r.offset(r.from+i+1) > off
+		})
+		skip = 1 + off - r.offset(from)
+	}
+
+	w := window{p: p, skip: skip}
+	if _, err := r.c.WriteRange(&w, from, r.to); err != nil && err != errFull {
+		return w.n, err
+	}
+	if w.n < len(p) {
+		return w.n, io.EOF
+	}
+	return w.n, nil
+}
+
+// Read implements the io.Reader interface.
+func (r *Reader) Read(p []byte) (n int, err error) {
+	if r.off >= r.size {
+		return 0, io.EOF
+	}
+	n, err = r.ReadAt(p, r.off)
+	r.off += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return
+}
+
+// Seek implements the io.Seeker interface.
+func (r *Reader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.off
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, errors.New("fizzbuzz.Reader.Seek: invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("fizzbuzz.Reader.Seek: negative position")
+	}
+	r.off = offset
+	return offset, nil
+}
@@ -0,0 +1,185 @@
+package fizzbuzz
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// chunkSize is the amount of bytes accumulated before writing them.
+const chunkSize = 32 << 10
+
+// Rule replaces the numbers divisible by Divisor with Str.
+type Rule struct {
+	Str     string `json:"str"`     // Str is the string that replaces the number when it is divisible by Divisor
+	Divisor int    `json:"divisor"` // Divisor is the divisor of the rule
+}
+
+// RuleConfig contains the parameters of a generalized Fizz buzz, with any number of rules.
+//
+// A number matching several rules is replaced by the concatenation of their strings, in the order of the rules.
+type RuleConfig struct {
+	Rules []Rule `json:"rules"` // Rules is the ordered list of rules
+	Limit int    `json:"limit"` // Limit is the last number of the Fizz buzz suite (1 being the first)
+}
+
+// validate returns an ErrInvalidInput if a divisor is negative or zero.
+func (c *RuleConfig) validate() error {
+	for i, r := range c.Rules {
+		if r.Divisor < 1 {
+			return fmt.Errorf("%w: divisor of rule %d must be strictly positive", ErrInvalidInput, i+1)
+		}
+	}
+	return nil
+}
+
+// ValueAt returns the Fizz buzz value at position i (1 being the first).
+//
+// It returns an ErrInvalidInput if the config is invalid or if i is not between 1 and Limit.
+func (c *RuleConfig) ValueAt(i int) (string, error) {
+	if err := c.validate(); err != nil {
+		return "", err
+	}
+	if i < 1 || i > c.Limit {
+		return "", fmt.Errorf("%w: position %d is out of range [1, %d]", ErrInvalidInput, i, c.Limit)
+	}
+	var s string
+	matched := false
+	for _, r := range c.Rules {
+		if i%r.Divisor == 0 {
+			s += r.Str
+			matched = true
+		}
+	}
+	if !matched {
+		return strconv.Itoa(i), nil
+	}
+	return s, nil
+}
+
+// clamp restricts the range of positions from-to to the values of the Fizz buzz, which starts with 1 and ends with Limit.
+// The range is empty if from > to.
+func (c *RuleConfig) clamp(from, to int) (int, int) {
+	if from < 1 {
+		from = 1
+	}
+	if to > c.Limit {
+		to = c.Limit
+	}
+	return from, to
+}
+
+// WriteTo writes a list of Fizz buzz values as a JSON array of strings, followed by a newline character.
+//
+// Attempting to write a Fizz buzz with negative or zero divisors causes WriteTo to return an ErrInvalidInput.
+// Any other errors reported may be due to w.Write.
+func (c *RuleConfig) WriteTo(w io.Writer) (n int64, err error) {
+	return c.WriteRange(w, 1, c.Limit)
+}
+
+// WriteRange is like WriteTo but only writes the values from position from to position to (both included, 1 being the first).
+// The range is clamped to the values of the Fizz buzz, so the array is empty if it doesn't contain any of them.
+//
+// The values are computed directly from the rules, so the ones before from are never produced.
+// The array contains the same JSON strings as WriteTo for the same positions.
+func (c *RuleConfig) WriteRange(w io.Writer, from, to int) (n int64, err error) {
+	return c.WriteRangeContext(context.Background(), w, from, to, nil)
+}
+
+// WriteRangeContext is like WriteRange but stops with the context error as soon as ctx is done.
+// The context is checked before writing each chunk of values, and progress (if not nil) is called after.
+func (c *RuleConfig) WriteRangeContext(ctx context.Context, w io.Writer, from, to int, progress Progress) (n int64, err error) {
+	// Check the config validity
+	if err := c.validate(); err != nil {
+		return 0, err
+	}
+
+	cw := chunkWriter{ctx: ctx, w: w, progress: progress}
+	defer func() { n, err = cw.n, cw.err }()
+
+	from, to = c.clamp(from, to)
+	if from > to {
+		cw.write(empty, 0)
+		return
+	}
+	count := to - from + 1
+
+	// Marshal the strings once, without the quotes, so that they can be concatenated
+	strs := make([][]byte, len(c.Rules))
+	for i, r := range c.Rules {
+		s := marshalJSON(r.Str)
+		strs[i] = s[1 : len(s)-1]
+	}
+
+	// t is the template of a period, if it is worth building one
+	t := newTemplate(c.Rules, strs, count)
+
+	// num holds the last number formatted from the template
+	var num counter
+	num.set(0)
+
+	// buf is used to accumulate the bytes of the Fizz buzz JSON strings, each one followed by a comma.
+	// Its initial capacity is an estimate of what is needed to avoid memory allocations:
+	// a chunk, plus the largest thing that can be appended to it (a value or a period).
+	size := chunkSize
+	if count < chunkSize/8 {
+		size = count * 8
+	}
+	size += len("\"\",") + 19 // 19 being the number of digits of math.MaxInt
+	for _, s := range strs {
+		size += len(s)
+	}
+	if t != nil {
+		size += len(t.fixed) + 19*len(t.segments)
+	}
+	buf := make([]byte, 0, size)
+
+	// Open the JSON array
+	buf = append(buf, '[')
+
+	// intBuf is a buffer big enough to hold math.MaxInt (9223372036854775807), used to format an int
+	intBuf := make([]byte, 0, 19)
+
+	// Iterate over the Fizz buzz values, done being the position of the last value appended
+	for done := from - 1; done < to; {
+		if t != nil && done%t.period == 0 && to-done >= t.period {
+			// A whole period remains, fill in its template
+			buf = t.appendPeriod(buf, &num, done)
+			done += t.period
+		} else {
+			done++
+			buf = append(buf, '"')
+
+			// Append the strings of all the rules matching done, in order
+			matched := false
+			for j, r := range c.Rules {
+				if done%r.Divisor == 0 {
+					buf = append(buf, strs[j]...)
+					matched = true
+				}
+			}
+			if !matched {
+				// done is not divisible by any divisor, append the number itself
+				buf = append(buf, strconv.AppendInt(intBuf, int64(done), 10)...)
+			}
+
+			buf = append(buf, '"', ',')
+		}
+
+		// Write the buffer once it is big enough, while keeping at least one value for the end
+		if len(buf) >= chunkSize && done < to {
+			if !cw.write(buf, done-from+1) {
+				return
+			}
+			// Truncate the slice while keeping the underlying storage intact to avoid unnecessary memory allocations
+			buf = buf[:0]
+		}
+	}
+
+	// Replace the last comma to close the JSON array and add a newline to be consistent with (*json.Encoder).Encode
+	buf[len(buf)-1] = ']'
+	buf = append(buf, '\n')
+	cw.write(buf, count)
+	return
+}
@@ -0,0 +1,101 @@
+package fizzbuzz
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// Shape is the shape of the values in the JSON and NDJSON formats.
+type Shape int
+
+const (
+	Strings Shape = iota // Strings are JSON strings: "fizzbuzz"
+	Objects              // Objects are JSON objects with the position, the value and its kind: {"n":6,"value":"fizzbuzz","kind":"both"}
+	Tuples               // Tuples are JSON arrays with the position, the value and its kind: [6,"fizzbuzz","both"]
+)
+
+var shapeNames = [...]string{"strings", "objects", "tuples"}
+
+// valid reports whether s is Strings, Objects or Tuples.
+func (s Shape) valid() bool {
+	return s >= 0 && int(s) < len(shapeNames)
+}
+
+func (s Shape) String() string {
+	if !s.valid() {
+		return "Shape(" + strconv.Itoa(int(s)) + ")"
+	}
+	return shapeNames[s]
+}
+
+// MarshalText implements the encoding.TextMarshaler interface.
+func (s Shape) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// UnmarshalText implements the encoding.TextUnmarshaler interface.
+func (s *Shape) UnmarshalText(text []byte) error {
+	for shape, name := range shapeNames {
+		if name == string(text) {
+			*s = Shape(shape)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown shape %q", text)
+}
+
+// appendElement appends a JSON value of the shape s, v being the digits of i or the JSON string.
+func appendElement(buf []byte, s Shape, i int, kind Kind, v []byte) []byte {
+	switch s {
+	case Objects:
+		buf = append(buf, `{"n":`...)
+		buf = strconv.AppendInt(buf, int64(i), 10)
+		buf = append(buf, `,"value":`...)
+	case Tuples:
+		buf = append(buf, '[')
+		buf = strconv.AppendInt(buf, int64(i), 10)
+		buf = append(buf, ',')
+	}
+
+	if kind == KindNumber {
+		buf = append(buf, '"')
+		buf = append(buf, v...)
+		buf = append(buf, '"')
+	} else {
+		buf = append(buf, v...)
+	}
+
+	switch s {
+	case Objects:
+		buf = append(buf, `,"kind":"`...)
+		buf = append(buf, kindNames[kind]...)
+		buf = append(buf, `"}`...)
+	case Tuples:
+		buf = append(buf, `,"`...)
+		buf = append(buf, kindNames[kind]...)
+		buf = append(buf, `"]`...)
+	}
+	return buf
+}
+
+// jsonEncoder returns the encoder of the JSON or NDJSON format f, with values of the shape s.
+func jsonEncoder(f Format, s Shape) encoder {
+	if f == NDJSON {
+		return encoder{
+			escape: marshalJSON,
+			value: func(buf []byte, i int, kind Kind, v []byte) []byte {
+				return append(appendElement(buf, s, i, kind, v), '\n')
+			},
+		}
+	}
+	return encoder{
+		begin:  fixed("["),
+		sep:    []byte{','},
+		end:    []byte("]\n"),
+		empty:  empty,
+		escape: marshalJSON,
+		value: func(buf []byte, i int, kind Kind, v []byte) []byte {
+			return appendElement(buf, s, i, kind, v)
+		},
+	}
+}
@@ -0,0 +1,251 @@
+package stats
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+
+	"github.com/xpetit/fizzbuzz/v5"
+)
+
+// counter is the count of a config in a summary, which overestimates its hits by at most err.
+type counter struct {
+	cfg        fizzbuzz.Config
+	count, err int
+	index      int // index is the position of the counter in the heap
+}
+
+// minHeap orders the counters of a summary, the first one being the next one to be replaced.
+type minHeap []*counter
+
+func (h minHeap) Len() int { return len(h) }
+
+func (h minHeap) Less(i, j int) bool {
+	if h[i].count != h[j].count {
+		return h[i].count < h[j].count
+	}
+	// Replace the biggest config first, as it is ranked last
+	return smaller(h[j].cfg, h[i].cfg)
+}
+
+func (h minHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *minHeap) Push(x any) {
+	c := x.(*counter)
+	c.index = len(*h)
+	*h = append(*h, c)
+}
+
+func (h *minHeap) Pop() any {
+	old := *h
+	c := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return c
+}
+
+// summary is a Space-Saving summary of at most k counters: the configs with the most hits are kept,
+// and a new config replaces the one with the fewest hits, inheriting its count as error.
+// The error of a count is at most the number of hits divided by k.
+type summary struct {
+	k        int
+	counters map[fizzbuzz.Config]*counter
+	heap     minHeap
+	hits     int // hits is the total number of hits
+	floor    int // floor is the maximum count of the configs missing from a merged summary
+
+	// leader is the counter with the highest count, kept up to date by add
+	leader *counter
+}
+
+func newSummary(k int) *summary {
+	return &summary{
+		k:        k,
+		counters: map[fizzbuzz.Config]*counter{},
+	}
+}
+
+// min returns the maximum count of the configs missing from the summary:
+// the count of the counter to be replaced, or the floor if the summary isn't full.
+func (s *summary) min() int {
+	if len(s.heap) < s.k {
+		return s.floor
+	}
+	return s.heap[0].count
+}
+
+// add adds count hits of cfg, err of them being possibly overestimated.
+func (s *summary) add(cfg fizzbuzz.Config, count, err int) {
+	s.hits += count
+	c := s.counters[cfg]
+	switch {
+	case c != nil:
+		c.count += count
+		c.err += err
+		heap.Fix(&s.heap, c.index)
+	case len(s.heap) < s.k:
+		c = &counter{cfg: cfg, count: count, err: err}
+		s.counters[cfg] = c
+		heap.Push(&s.heap, c)
+	default:
+		c = s.heap[0]
+		delete(s.counters, c.cfg)
+		c.cfg = cfg
+		c.err = c.count + err
+		c.count += count
+		s.counters[cfg] = c
+		heap.Fix(&s.heap, 0)
+	}
+	// The counts only grow, and the replaced counter was the leader only if all the counts were equal,
+	// so a config can only become the most frequent one when it is added
+	if s.leader == nil || c.count > s.leader.count || c.count == s.leader.count && smaller(cfg, s.leader.cfg) {
+		s.leader = c
+	}
+}
+
+// mergeSummaries returns a summary of k counters holding the hits of all the summaries.
+// A config missing from a full summary may have had up to its minimum count, which is added to its error.
+func mergeSummaries(k int, summaries []*summary) *summary {
+	type estimate struct{ count, err int }
+	estimates := map[fizzbuzz.Config]estimate{}
+	var mins int
+	for _, s := range summaries {
+		mins += s.min()
+	}
+	for _, s := range summaries {
+		for cfg, c := range s.counters {
+			if _, ok := estimates[cfg]; !ok {
+				estimates[cfg] = estimate{mins, mins}
+			}
+			e := estimates[cfg]
+			e.count += c.count - s.min()
+			e.err += c.err - s.min()
+			estimates[cfg] = e
+		}
+	}
+	entries := make([]Entry, 0, len(estimates))
+	for cfg, e := range estimates {
+		entries = append(entries, Entry{Count: e.count, Config: cfg, Error: e.err})
+	}
+	merged := newSummary(k)
+	for _, e := range sortTop(entries, k) {
+		merged.add(e.Config, e.Count, e.Error)
+	}
+	merged.hits = 0
+	for _, s := range summaries {
+		merged.hits += s.hits
+	}
+	merged.floor = mins
+	return merged
+}
+
+type approx struct {
+	k        int
+	lifetime *summary
+	buckets  map[bucket]*summary
+	mu       sync.RWMutex
+}
+
+// Approx holds a protected (thread safe) approximate hit count of bounded memory: only k configs are counted
+// with the Space-Saving algorithm, the counts being overestimated by at most the number of hits divided by k.
+// The configs with more hits than that are guaranteed to be counted.
+//
+// The hits of the time windows are counted in the same way in each bucket of the retention,
+// so the memory is bounded by k counters for the lifetime stats, and k counters per bucket: about
+// Minutes/1m + Hours/1h + Days/1d buckets for a Retention, that is about 260×k counters in total with DefaultRetention.
+func Approx(k int) *approx {
+	if k < 1 {
+		k = 1
+	}
+	return &approx{
+		k:        k,
+		lifetime: newSummary(k),
+		buckets:  map[bucket]*summary{},
+	}
+}
+
+func (s *approx) Increment(cfg fizzbuzz.Config) error {
+	key := bucket{currentMinute(), minute}
+	s.mu.Lock()
+	s.lifetime.add(cfg, 1, 0)
+	b := s.buckets[key]
+	if b == nil {
+		b = newSummary(s.k)
+		s.buckets[key] = b
+	}
+	b.add(cfg, 1, 0)
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *approx) MostFrequent() (count int, cfg fizzbuzz.Config, err error) {
+	s.mu.RLock()
+	if l := s.lifetime.leader; l != nil {
+		count, cfg = l.count, l.cfg
+	}
+	s.mu.RUnlock()
+	return
+}
+
+// MaxError returns the maximum overestimation of the lifetime counts.
+func (s *approx) MaxError() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.lifetime.min()
+}
+
+func (s *approx) MostFrequentIn(w Window) (count int, cfg fizzbuzz.Config, err error) {
+	since, until := w.bounds()
+	var summaries []*summary
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for key, b := range s.buckets {
+		if key.start >= since && key.start < until {
+			summaries = append(summaries, b)
+		}
+	}
+	if l := mergeSummaries(s.k, summaries).leader; l != nil {
+		count, cfg = l.count, l.cfg
+	}
+	return
+}
+
+func (s *approx) TopN(n int, f Filter) ([]Entry, error) {
+	var entries []Entry
+	s.mu.RLock()
+	for cfg, c := range s.lifetime.counters {
+		if f.Match(cfg) {
+			entries = append(entries, Entry{Count: c.count, Config: cfg, Error: c.err})
+		}
+	}
+	s.mu.RUnlock()
+	return sortTop(entries, n), nil
+}
+
+func (s *approx) Compact(now time.Time, r Retention) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, st := range r.stages(now) {
+		merged := map[bucket][]*summary{}
+		for key, b := range s.buckets {
+			if st.size != 0 && key.size >= st.size || key.start+key.size > st.cutoff {
+				continue
+			}
+			delete(s.buckets, key)
+			if st.size != 0 {
+				target := bucket{key.start - key.start%st.size, st.size}
+				merged[target] = append(merged[target], b)
+			}
+		}
+		for key, summaries := range merged {
+			if b := s.buckets[key]; b != nil {
+				summaries = append(summaries, b)
+			}
+			s.buckets[key] = mergeSummaries(s.k, summaries)
+		}
+	}
+	return nil
+}
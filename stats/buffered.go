@@ -0,0 +1,290 @@
+package stats
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+	"time"
+
+	"github.com/xpetit/fizzbuzz/v5"
+)
+
+type buffered struct {
+	db   *db
+	size int
+
+	pending map[hit]int // pending holds the increments not yet written to db
+	err     error       // err is the last error of a background flush
+	mu      sync.Mutex  // mu protects pending and err
+
+	// flushing is held while the pending counts are written, so that they are never counted twice by MostFrequent
+	flushing sync.Mutex
+
+	full      chan struct{} // full is signaled when size configs are pending
+	done      chan struct{}
+	stopped   chan struct{}
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// Buffered holds a persistent and protected (thread safe) hit count, the increments being aggregated in memory
+// and written to db in one transaction every interval, or as soon as size distinct configs (per minute) are pending.
+// MostFrequent combines the persisted and pending counts, so it is exact. Increment doesn't reach db so it only fails
+// if its context is done: the failures of the background writes are returned by Err.
+//
+// It takes ownership of db and must be closed when it is no longer needed, which writes the pending increments.
+func Buffered(db *db, interval time.Duration, size int) *buffered {
+	s := &buffered{
+		db:      db,
+		size:    size,
+		pending: map[hit]int{},
+		full:    make(chan struct{}, 1),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	go s.run(interval)
+	return s
+}
+
+// run flushes the pending increments every interval or when they are too many, until the buffer is closed.
+func (s *buffered) run(interval time.Duration) {
+	defer close(s.stopped)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		case <-s.full:
+		}
+		err := s.flush(context.Background())
+		s.mu.Lock()
+		s.err = err
+		s.mu.Unlock()
+	}
+}
+
+// flush writes the pending increments to the database. In case of failure they are kept for the next flush.
+func (s *buffered) flush(ctx context.Context) error {
+	s.flushing.Lock()
+	defer s.flushing.Unlock()
+
+	s.mu.Lock()
+	hits := s.pending
+	s.pending = map[hit]int{}
+	s.mu.Unlock()
+	if len(hits) == 0 {
+		return nil
+	}
+
+	err := s.db.add(ctx, hits)
+	if err != nil {
+		s.mu.Lock()
+		for h, count := range hits {
+			s.pending[h] += count
+		}
+		s.mu.Unlock()
+	}
+	return err
+}
+
+// Increment counts cfg in memory, to be written by the next flush.
+func (s *buffered) Increment(cfg fizzbuzz.Config) error {
+	return s.IncrementContext(context.Background(), cfg)
+}
+
+// IncrementContext is like Increment, cfg isn't counted if ctx is done.
+func (s *buffered) IncrementContext(ctx context.Context, cfg fizzbuzz.Config) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	now := time.Now()
+	s.mu.Lock()
+	s.pending[hit{minuteOf(now), cfg}]++
+	full := len(s.pending) >= s.size
+	s.mu.Unlock()
+
+	if full {
+		select {
+		case s.full <- struct{}{}:
+		default: // a flush is already requested
+		}
+	}
+	return nil
+}
+
+// Err returns the error of the last background flush, nil if it succeeded.
+// The increments that failed to be written are kept in memory for the next flush.
+func (s *buffered) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// add writes the hits to the database, without buffering them, so that it fails if the database does.
+func (s *buffered) add(ctx context.Context, hits map[hit]int) error {
+	return s.db.add(ctx, hits)
+}
+
+// probe writes the pending increments and reads the database, so that it fails if the database does.
+func (s *buffered) probe(ctx context.Context) error {
+	if err := s.flush(ctx); err != nil {
+		return err
+	}
+	_, _, err := s.db.MostFrequentContext(ctx)
+	return err
+}
+
+// pendingCounts returns the pending counts of the configs in the window.
+func (s *buffered) pendingCounts(w Window) map[fizzbuzz.Config]int {
+	since, until := w.bounds()
+	counts := map[fizzbuzz.Config]int{}
+	s.mu.Lock()
+	for h, count := range s.pending {
+		if h.minute >= since && h.minute < until {
+			counts[h.cfg] += count
+		}
+	}
+	s.mu.Unlock()
+	return counts
+}
+
+func (s *buffered) MostFrequent() (count int, cfg fizzbuzz.Config, err error) {
+	return s.MostFrequentContext(context.Background())
+}
+
+func (s *buffered) MostFrequentContext(ctx context.Context) (count int, cfg fizzbuzz.Config, err error) {
+	return s.mostFrequent(ctx, func(ctx context.Context, tx *sql.Tx) (int, fizzbuzz.Config, error) {
+		return s.db.queryMostFrequent(ctx, tx.StmtContext(ctx, s.db.mostFrequent))
+	}, nil)
+}
+
+func (s *buffered) MostFrequentIn(w Window) (count int, cfg fizzbuzz.Config, err error) {
+	return s.MostFrequentInContext(context.Background(), w)
+}
+
+func (s *buffered) MostFrequentInContext(ctx context.Context, w Window) (count int, cfg fizzbuzz.Config, err error) {
+	since, until := w.bounds()
+	return s.mostFrequent(ctx, func(ctx context.Context, tx *sql.Tx) (int, fizzbuzz.Config, error) {
+		return s.db.queryMostFrequent(ctx, tx.StmtContext(ctx, s.db.mostFrequentIn), since, until)
+	}, &w)
+}
+
+// mostFrequent combines the pending counts in the window (the lifetime if w is nil) with the persisted ones,
+// given by the persisted leader and the persisted counts of the pending configs, both read in the same transaction.
+func (s *buffered) mostFrequent(
+	ctx context.Context,
+	leader func(ctx context.Context, tx *sql.Tx) (int, fizzbuzz.Config, error),
+	w *Window,
+) (count int, cfg fizzbuzz.Config, err error) {
+	// Prevent the pending counts from being written while they are combined with the persisted ones
+	s.flushing.Lock()
+	defer s.flushing.Unlock()
+
+	window := Window{}
+	if w != nil {
+		window = *w
+	}
+	pending := s.pendingCounts(window)
+
+	tx, err := s.db.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, cfg, err
+	}
+	defer tx.Rollback()
+
+	// The leader is either the persisted one, or one of the pending configs.
+	// Indeed if the persisted leader has pending increments, it is also a pending config with a greater count.
+	count, cfg, err = leader(ctx, tx)
+	if err != nil {
+		return 0, cfg, err
+	}
+	configs := make([]fizzbuzz.Config, 0, len(pending))
+	for config := range pending {
+		configs = append(configs, config)
+	}
+	persisted, err := s.db.countsOf(ctx, tx, configs, w)
+	if err != nil {
+		return 0, cfg, err
+	}
+	for config, c := range pending {
+		if c += persisted[config]; c > count || c == count && smaller(config, cfg) {
+			count = c
+			cfg = config
+		}
+	}
+	return count, cfg, tx.Commit()
+}
+
+func (s *buffered) Compact(now time.Time, r Retention) error {
+	return s.CompactContext(context.Background(), now, r)
+}
+
+func (s *buffered) CompactContext(ctx context.Context, now time.Time, r Retention) error {
+	// The pending hits are written first, so that they are compacted as well
+	if err := s.flush(ctx); err != nil {
+		return err
+	}
+	return s.db.CompactContext(ctx, now, r)
+}
+
+func (s *buffered) TopN(n int, f Filter) ([]Entry, error) {
+	return s.TopNContext(context.Background(), n, f)
+}
+
+func (s *buffered) TopNContext(ctx context.Context, n int, f Filter) ([]Entry, error) {
+	// Prevent the pending counts from being written while they are combined with the persisted ones
+	s.flushing.Lock()
+	defer s.flushing.Unlock()
+
+	pending := appendMatches(nil, s.pendingCounts(Window{}), f)
+
+	tx, err := s.db.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// The persisted configs without pending increments keep their rank among themselves,
+	// so the ones in the result are among the n+len(pending) first persisted ones.
+	entries, err := s.db.topN(ctx, tx, n+len(pending), f)
+	if err != nil {
+		return nil, err
+	}
+	configs := make([]fizzbuzz.Config, len(pending))
+	for i, e := range pending {
+		configs[i] = e.Config
+	}
+	persisted, err := s.db.countsOf(ctx, tx, configs, nil)
+	if err != nil {
+		return nil, err
+	}
+	isPending := make(map[fizzbuzz.Config]bool, len(pending))
+	for i, e := range pending {
+		pending[i].Count += persisted[e.Config]
+		isPending[e.Config] = true
+	}
+	for _, e := range entries {
+		if !isPending[e.Config] {
+			pending = append(pending, e)
+		}
+	}
+	return sortTop(pending, n), tx.Commit()
+}
+
+// Close writes the pending increments and closes the database.
+func (s *buffered) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.done)
+		<-s.stopped
+		// The background flushes are stopped, write the last increments
+		if err := s.flush(context.Background()); err != nil {
+			s.closeErr = err
+			s.db.Close()
+			return
+		}
+		s.closeErr = s.db.Close()
+	})
+	return s.closeErr
+}
@@ -0,0 +1,66 @@
+package stats
+
+import (
+	"context"
+	"time"
+
+	"github.com/xpetit/fizzbuzz/v5"
+)
+
+// WithContext returns s as a ContextService. If s doesn't implement it, its calls are made only if their context
+// isn't done yet, as the in-memory services return immediately. The returned service is Approximate if s is.
+func WithContext(s Service) ContextService {
+	if cs, ok := s.(ContextService); ok {
+		return cs
+	}
+	if a, ok := s.(Approximate); ok {
+		return approximateContext{contextService{s}, a}
+	}
+	return contextService{s}
+}
+
+// contextService adapts a Service to ContextService.
+type contextService struct {
+	Service
+}
+
+func (s contextService) IncrementContext(ctx context.Context, cfg fizzbuzz.Config) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.Increment(cfg)
+}
+
+func (s contextService) MostFrequentContext(ctx context.Context) (count int, cfg fizzbuzz.Config, err error) {
+	if err := ctx.Err(); err != nil {
+		return 0, cfg, err
+	}
+	return s.MostFrequent()
+}
+
+func (s contextService) MostFrequentInContext(ctx context.Context, w Window) (count int, cfg fizzbuzz.Config, err error) {
+	if err := ctx.Err(); err != nil {
+		return 0, cfg, err
+	}
+	return s.MostFrequentIn(w)
+}
+
+func (s contextService) TopNContext(ctx context.Context, n int, f Filter) ([]Entry, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return s.TopN(n, f)
+}
+
+func (s contextService) CompactContext(ctx context.Context, now time.Time, r Retention) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.Compact(now, r)
+}
+
+// approximateContext is the adapter of an approximate service.
+type approximateContext struct {
+	contextService
+	Approximate
+}
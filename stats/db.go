@@ -3,9 +3,11 @@ package stats
 import (
 	"context"
 	"database/sql"
+	"math"
 	"net/url"
 	"runtime"
 	"strings"
+	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 
@@ -13,19 +15,18 @@ import (
 )
 
 type db struct {
-	ctx          context.Context
-	db           *sql.DB
-	increment    *sql.Stmt
-	mostFrequent *sql.Stmt
+	db              *sql.DB
+	increment       *sql.Stmt
+	incrementBucket *sql.Stmt
+	mostFrequent    *sql.Stmt
+	mostFrequentIn  *sql.Stmt
+	compactBuckets  *sql.Stmt
+	deleteBuckets   *sql.Stmt
 }
 
-// OpenDB opens a database holding a persistent and protected (thread safe) hit count.
-// It must be closed when it is no longer needed.
-func OpenDB(ctx context.Context, dataSourceName string) (*db, error) {
-	db := &db{ctx: ctx}
-	var err error
-
-	db.db, err = sql.Open("sqlite3", dataSourceName+"?"+url.Values{
+// openSQLite opens a SQLite database with the settings of the stats.
+func openSQLite(ctx context.Context, dataSourceName string) (*sql.DB, error) {
+	db, err := sql.Open("sqlite3", dataSourceName+"?"+url.Values{
 		"_busy_timeout":        {"5000"},
 		"_foreign_keys":        {"true"},
 		"_journal_mode":        {"wal"},
@@ -39,36 +40,35 @@ func OpenDB(ctx context.Context, dataSourceName string) (*db, error) {
 
 	// Adjust database/sql settings to SQLite to avoid ever-growing WAL file
 	if strings.Contains(dataSourceName, "memory") {
-		db.db.SetMaxOpenConns(1)
+		db.SetMaxOpenConns(1)
 	} else {
-		db.db.SetMaxOpenConns(runtime.NumCPU())
-		db.db.SetMaxIdleConns(runtime.NumCPU())
+		db.SetMaxOpenConns(runtime.NumCPU())
+		db.SetMaxIdleConns(runtime.NumCPU())
 	}
 
 	// Improve SQLite performance
-	if _, err := db.db.ExecContext(ctx, `pragma temp_store = memory`); err != nil {
+	if _, err := db.ExecContext(ctx, `pragma temp_store = memory`); err != nil {
+		db.Close()
 		return nil, err
 	}
+	return db, nil
+}
 
-	// Initialize database
-	if _, err := db.db.ExecContext(ctx, `
-		create table if not exists "stat" (
-			"limit" integer not null,
-			"int1"  integer not null,
-			"int2"  integer not null,
-			"str1"  text    not null,
-			"str2"  text    not null,
-			"count" integer not null,
-			primary key (
-				"limit",
-				"int1",
-				"int2",
-				"str1",
-				"str2"
-			)
-		) strict, without rowid;
-		create index if not exists "idx_stat_count" on "stat" ("count");
-	`); err != nil {
+// OpenDB opens a database holding a persistent and protected (thread safe) hit count, ctx being only used to open it.
+// Its schema is created or upgraded to the last migration (see MigrateDB).
+// It must be closed when it is no longer needed.
+func OpenDB(ctx context.Context, dataSourceName string) (*db, error) {
+	db := &db{}
+	var err error
+
+	db.db, err = openSQLite(ctx, dataSourceName)
+	if err != nil {
+		return nil, err
+	}
+
+	// Initialize or upgrade the schema
+	if err := migrate(ctx, db.db, len(migrations)); err != nil {
+		db.db.Close()
 		return nil, err
 	}
 
@@ -87,9 +87,112 @@ func OpenDB(ctx context.Context, dataSourceName string) (*db, error) {
 			?, -- int2
 			?, -- str1
 			?, -- str2
-			1  -- count
+			?  -- count
+		) on conflict do update set
+			"count" = "count" + excluded."count";
+	`)
+	if err != nil {
+		return nil, err
+	}
+	db.incrementBucket, err = db.db.PrepareContext(ctx, `
+		insert into "stat_bucket" (
+			"start",
+			"size",
+			"limit",
+			"int1",
+			"int2",
+			"str1",
+			"str2",
+			"count"
+		) values (
+			?,  -- start
+			60, -- size
+			?,  -- limit
+			?,  -- int1
+			?,  -- int2
+			?,  -- str1
+			?,  -- str2
+			?   -- count
 		) on conflict do update set
-			"count" = "count" + 1;
+			"count" = "count" + excluded."count";
+	`)
+	if err != nil {
+		return nil, err
+	}
+	db.mostFrequentIn, err = db.db.PrepareContext(ctx, `
+		select
+			"limit",
+			"int1",
+			"int2",
+			"str1",
+			"str2",
+			sum("count") as "total"
+		from
+			"stat_bucket"
+		where
+			"start" >= ? and
+			"start" <  ?
+		group by
+			"limit",
+			"int1",
+			"int2",
+			"str1",
+			"str2"
+		order by
+			"total" desc,
+			"limit",
+			"int1",
+			"int2",
+			"str1",
+			"str2"
+		limit 1;
+	`)
+	if err != nil {
+		return nil, err
+	}
+	db.compactBuckets, err = db.db.PrepareContext(ctx, `
+		insert into "stat_bucket" (
+			"start",
+			"size",
+			"limit",
+			"int1",
+			"int2",
+			"str1",
+			"str2",
+			"count"
+		) select
+			"start" - "start" % ?1,
+			?1,
+			"limit",
+			"int1",
+			"int2",
+			"str1",
+			"str2",
+			sum("count")
+		from
+			"stat_bucket"
+		where
+			"size" < ?1 and
+			"start" + "size" <= ?2
+		group by
+			1,
+			"limit",
+			"int1",
+			"int2",
+			"str1",
+			"str2"
+		on conflict do update set
+			"count" = "count" + excluded."count";
+	`)
+	if err != nil {
+		return nil, err
+	}
+	db.deleteBuckets, err = db.db.PrepareContext(ctx, `
+		delete from
+			"stat_bucket"
+		where
+			"size" < ?1 and
+			"start" + "size" <= ?2;
 	`)
 	if err != nil {
 		return nil, err
@@ -122,18 +225,186 @@ func OpenDB(ctx context.Context, dataSourceName string) (*db, error) {
 }
 
 func (s *db) Increment(cfg fizzbuzz.Config) error {
-	_, err := s.increment.ExecContext(s.ctx,
-		cfg.Limit,
-		cfg.Int1,
-		cfg.Int2,
-		cfg.Str1,
-		cfg.Str2,
-	)
-	return err
+	return s.IncrementContext(context.Background(), cfg)
+}
+
+func (s *db) IncrementContext(ctx context.Context, cfg fizzbuzz.Config) error {
+	return s.add(ctx, map[hit]int{{minuteOf(time.Now()), cfg}: 1})
+}
+
+// add adds the hits to the lifetime and bucket counts, in one transaction.
+func (s *db) add(ctx context.Context, hits map[hit]int) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	increment := tx.StmtContext(ctx, s.increment)
+	incrementBucket := tx.StmtContext(ctx, s.incrementBucket)
+	for h, count := range hits {
+		if _, err := increment.ExecContext(ctx,
+			h.cfg.Limit,
+			h.cfg.Int1,
+			h.cfg.Int2,
+			h.cfg.Str1,
+			h.cfg.Str2,
+			count,
+		); err != nil {
+			return err
+		}
+		if _, err := incrementBucket.ExecContext(ctx,
+			h.minute,
+			h.cfg.Limit,
+			h.cfg.Int1,
+			h.cfg.Int2,
+			h.cfg.Str1,
+			h.cfg.Str2,
+			count,
+		); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// dbCountsBatch is the maximum number of configs whose counts are read by a query of countsOf,
+// keeping the number of parameters below the SQLite limit (32766).
+const dbCountsBatch = 1000
+
+// countsOf returns the persisted counts of the configs, in the window if w isn't nil, reading them in tx.
+// The configs without persisted hits are missing from the result.
+func (s *db) countsOf(ctx context.Context, tx *sql.Tx, cfgs []fizzbuzz.Config, w *Window) (map[fizzbuzz.Config]int, error) {
+	counts := make(map[fizzbuzz.Config]int, len(cfgs))
+	for len(cfgs) > 0 {
+		batch := cfgs
+		if len(batch) > dbCountsBatch {
+			batch = batch[:dbCountsBatch]
+		}
+		cfgs = cfgs[len(batch):]
+
+		values := make([]string, len(batch))
+		args := make([]any, 0, 2+5*len(batch))
+		for i, cfg := range batch {
+			values[i] = "(?, ?, ?, ?, ?)"
+			args = append(args, cfg.Limit, cfg.Int1, cfg.Int2, cfg.Str1, cfg.Str2)
+		}
+		query := `
+		with "config" ("limit", "int1", "int2", "str1", "str2") as (
+			values ` + strings.Join(values, ", ") + `
+		)`
+		if w == nil {
+			query += `
+		select
+			"limit",
+			"int1",
+			"int2",
+			"str1",
+			"str2",
+			"count"
+		from
+			"stat" join "config" using ("limit", "int1", "int2", "str1", "str2");`
+		} else {
+			since, until := w.bounds()
+			args = append(args, since, until)
+			query += `
+		select
+			"limit",
+			"int1",
+			"int2",
+			"str1",
+			"str2",
+			sum("count")
+		from
+			"stat_bucket" join "config" using ("limit", "int1", "int2", "str1", "str2")
+		where
+			"start" >= ? and
+			"start" <  ?
+		group by
+			"limit",
+			"int1",
+			"int2",
+			"str1",
+			"str2";`
+		}
+		if err := s.scanCounts(ctx, tx, counts, query, args); err != nil {
+			return nil, err
+		}
+	}
+	return counts, nil
+}
+
+// scanCounts adds the configs and counts returned by the query to counts.
+func (s *db) scanCounts(ctx context.Context, tx *sql.Tx, counts map[fizzbuzz.Config]int, query string, args []any) error {
+	rows, err := tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var cfg fizzbuzz.Config
+		var count int
+		if err := rows.Scan(
+			&cfg.Limit,
+			&cfg.Int1,
+			&cfg.Int2,
+			&cfg.Str1,
+			&cfg.Str2,
+			&count,
+		); err != nil {
+			return err
+		}
+		counts[cfg] += count
+	}
+	return rows.Err()
 }
 
 func (s *db) MostFrequent() (count int, cfg fizzbuzz.Config, err error) {
-	err = s.mostFrequent.QueryRowContext(s.ctx).Scan(
+	return s.MostFrequentContext(context.Background())
+}
+
+func (s *db) MostFrequentContext(ctx context.Context) (count int, cfg fizzbuzz.Config, err error) {
+	return s.queryMostFrequent(ctx, s.mostFrequent)
+}
+
+func (s *db) MostFrequentIn(w Window) (count int, cfg fizzbuzz.Config, err error) {
+	return s.MostFrequentInContext(context.Background(), w)
+}
+
+func (s *db) MostFrequentInContext(ctx context.Context, w Window) (count int, cfg fizzbuzz.Config, err error) {
+	since, until := w.bounds()
+	return s.queryMostFrequent(ctx, s.mostFrequentIn, since, until)
+}
+
+func (s *db) Compact(now time.Time, r Retention) error {
+	return s.CompactContext(context.Background(), now, r)
+}
+
+// CompactContext runs the stages of the compaction in one transaction.
+func (s *db) CompactContext(ctx context.Context, now time.Time, r Retention) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, st := range r.stages(now) {
+		size := st.size
+		if size == 0 {
+			size = math.MaxInt64 // drop the buckets of any size
+		} else if _, err := tx.StmtContext(ctx, s.compactBuckets).ExecContext(ctx, size, st.cutoff); err != nil {
+			return err
+		}
+		if _, err := tx.StmtContext(ctx, s.deleteBuckets).ExecContext(ctx, size, st.cutoff); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// queryMostFrequent runs a statement (which may be bound to a transaction) returning the most frequent config.
+func (s *db) queryMostFrequent(ctx context.Context, stmt *sql.Stmt, args ...any) (count int, cfg fizzbuzz.Config, err error) {
+	err = stmt.QueryRowContext(ctx, args...).Scan(
 		&cfg.Limit,
 		&cfg.Int1,
 		&cfg.Int2,
@@ -147,10 +418,108 @@ func (s *db) MostFrequent() (count int, cfg fizzbuzz.Config, err error) {
 	return
 }
 
+func (s *db) TopN(n int, f Filter) ([]Entry, error) {
+	return s.TopNContext(context.Background(), n, f)
+}
+
+func (s *db) TopNContext(ctx context.Context, n int, f Filter) ([]Entry, error) {
+	return s.topN(ctx, s.db, n, f)
+}
+
+// querier is implemented by *sql.DB and *sql.Tx.
+type querier interface {
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+}
+
+// likePrefix returns the LIKE pattern (escaped with '\') matching the strings starting with prefix.
+func likePrefix(prefix string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(prefix) + "%"
+}
+
+// topN runs the TopN query with q, the ordering being the same as the one of the other services.
+func (s *db) topN(ctx context.Context, q querier, n int, f Filter) ([]Entry, error) {
+	var where []string
+	var args []any
+	for _, c := range []struct {
+		cond  string
+		value *int
+	}{
+		{`"limit" >= ?`, f.MinLimit},
+		{`"limit" <= ?`, f.MaxLimit},
+		{`"int1" = ?`, f.Int1},
+		{`"int2" = ?`, f.Int2},
+	} {
+		if c.value != nil {
+			where = append(where, c.cond)
+			args = append(args, *c.value)
+		}
+	}
+	if f.Str1Prefix != "" {
+		where = append(where, `"str1" like ? escape '\'`)
+		args = append(args, likePrefix(f.Str1Prefix))
+	}
+	if f.Str2Prefix != "" {
+		where = append(where, `"str2" like ? escape '\'`)
+		args = append(args, likePrefix(f.Str2Prefix))
+	}
+	query := `
+		select
+			"limit",
+			"int1",
+			"int2",
+			"str1",
+			"str2",
+			"count"
+		from
+			"stat"`
+	if len(where) > 0 {
+		query += `
+		where
+			` + strings.Join(where, " and\n\t\t\t")
+	}
+	query += `
+		order by
+			"count" desc,
+			"limit",
+			"int1",
+			"int2",
+			"str1",
+			"str2"
+		limit ?;
+	`
+	args = append(args, n)
+
+	rows, err := q.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var entries []Entry
+	for rows.Next() {
+		var e Entry
+		if err := rows.Scan(
+			&e.Config.Limit,
+			&e.Config.Int1,
+			&e.Config.Int2,
+			&e.Config.Str1,
+			&e.Config.Str2,
+			&e.Count,
+		); err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
 func (s *db) Close() error {
 	stmts := []*sql.Stmt{
 		s.increment,
+		s.incrementBucket,
 		s.mostFrequent,
+		s.mostFrequentIn,
+		s.compactBuckets,
+		s.deleteBuckets,
 	}
 	for _, stmt := range stmts {
 		if err := stmt.Close(); err != nil {
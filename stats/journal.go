@@ -0,0 +1,298 @@
+package stats
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xpetit/fizzbuzz/v5"
+)
+
+// ErrCorruptJournal is returned when opening a journal whose log has been altered before its last record.
+var ErrCorruptJournal = errors.New("corrupt journal")
+
+// The extensions of the files of a journal, named after their generation
+const (
+	logExt        = ".log"
+	checkpointExt = ".checkpoint"
+)
+
+type journal struct {
+	mem *memory
+	dir string
+
+	f       *os.File // f is the log of the increments since the last checkpoint, nil once closed
+	gen     uint64   // gen is the generation of f
+	size    int64    // size is the size of f
+	records int      // records is the number of records in f
+	// mu protects the fields above and keeps the records in the order of the increments of mem
+	mu sync.Mutex
+
+	// checkpointing is held while a checkpoint is written
+	checkpointing sync.Mutex
+	closeOnce     sync.Once
+	closeErr      error
+}
+
+// OpenJournal opens the journal in dir (created if needed), holding a persistent and protected (thread safe) hit count
+// without SQLite. The hits are counted in memory and appended as records to a log, which is replaced by a checkpoint
+// (a snapshot of the counts) on each compaction.
+//
+// On opening, the counts are restored from the last checkpoint and the logs written after it. A torn record at the end
+// of the last log, left by a crash while it was written, is discarded.
+//
+// It must be closed when it is no longer needed, which writes a last checkpoint.
+func OpenJournal(dir string) (*journal, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	// The names have a fixed size so the generations are sorted
+	var checkpoint uint64 // 0 if there is no checkpoint, the generations start at 1
+	var logs []uint64
+	for _, e := range entries {
+		name := e.Name()
+		if gen, ok := parseGen(name, checkpointExt); ok {
+			checkpoint = gen
+		} else if gen, ok := parseGen(name, logExt); ok {
+			logs = append(logs, gen)
+		} else if strings.HasSuffix(name, ".tmp") {
+			// Left by a crash while a checkpoint was written
+			if err := os.Remove(filepath.Join(dir, name)); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	s := &journal{mem: Memory(), dir: dir, gen: checkpoint + 1}
+	if checkpoint > 0 {
+		if err := LoadSnapshot(s.mem, s.path(checkpoint, checkpointExt)); err != nil {
+			return nil, fmt.Errorf("checkpoint %d: %w", checkpoint, err)
+		}
+	}
+	for i, gen := range logs {
+		if gen <= checkpoint {
+			// Left by a crash after the checkpoint was written, the log is part of it
+			if err := os.Remove(s.path(gen, logExt)); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		last := i == len(logs)-1
+		if err := s.replay(gen, last); err != nil {
+			return nil, err
+		}
+		if last {
+			s.gen = gen
+		}
+	}
+
+	s.f, err = os.OpenFile(s.path(s.gen, logExt), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// parseGen returns the generation of the file name, if it has the extension ext.
+func parseGen(name, ext string) (uint64, bool) {
+	name, ok := strings.CutSuffix(name, ext)
+	if !ok || len(name) != 16 {
+		return 0, false
+	}
+	gen, err := strconv.ParseUint(name, 16, 64)
+	return gen, err == nil
+}
+
+// path returns the path of the file of the given generation and extension.
+func (s *journal) path(gen uint64, ext string) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%016x%s", gen, ext))
+}
+
+// replay adds the hits of a log to the counts. If the log is the last one, it is truncated after its last valid record,
+// the following bytes being a torn record.
+func (s *journal) replay(gen uint64, last bool) error {
+	path := s.path(gen, logExt)
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var n, records int
+	for n < len(b) {
+		h, size := decodeRecord(b[n:])
+		if size == 0 {
+			break
+		}
+		s.mem.hit(h)
+		n += size
+		records++
+	}
+	if n < len(b) {
+		if !last {
+			return fmt.Errorf("%w: invalid record at offset %d of %s", ErrCorruptJournal, n, path)
+		}
+		if err := os.Truncate(path, int64(n)); err != nil {
+			return err
+		}
+	}
+	s.size, s.records = int64(n), records
+	return nil
+}
+
+// appendRecord appends the record of a hit: the size of its content, the content (the minute and the config)
+// and the CRC-32 (IEEE) of the content.
+func appendRecord(buf []byte, h hit) []byte {
+	content := appendConfig(binary.AppendVarint(nil, h.minute), h.cfg)
+	buf = binary.AppendUvarint(buf, uint64(len(content)))
+	buf = append(buf, content...)
+	return binary.LittleEndian.AppendUint32(buf, crc32.ChecksumIEEE(content))
+}
+
+// decodeRecord decodes the record at the start of b, returning its size, or 0 if it is incomplete or altered.
+func decodeRecord(b []byte) (h hit, size int) {
+	n, k := binary.Uvarint(b)
+	if k <= 0 || len(b)-k < 4 || n > uint64(len(b)-k-4) {
+		return h, 0
+	}
+	content := b[k : k+int(n)]
+	if crc32.ChecksumIEEE(content) != binary.LittleEndian.Uint32(b[k+int(n):]) {
+		return h, 0
+	}
+	d := snapshotDecoder{r: bytes.NewReader(content)}
+	h.minute = d.varint()
+	h.cfg = d.config()
+	if d.err != nil || d.r.Len() > 0 {
+		return h, 0
+	}
+	return h, k + int(n) + 4
+}
+
+func (s *journal) Increment(cfg fizzbuzz.Config) error {
+	h := hit{currentMinute(), cfg}
+	record := appendRecord(nil, h)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.f == nil {
+		return os.ErrClosed
+	}
+	if _, err := s.f.Write(record); err != nil {
+		// Remove the part of the record that may have been written, so that the next ones can be read
+		s.f.Truncate(s.size)
+		return err
+	}
+	s.size += int64(len(record))
+	s.records++
+	s.mem.hit(h)
+	return nil
+}
+
+func (s *journal) MostFrequent() (count int, cfg fizzbuzz.Config, err error) {
+	return s.mem.MostFrequent()
+}
+
+func (s *journal) MostFrequentIn(w Window) (count int, cfg fizzbuzz.Config, err error) {
+	return s.mem.MostFrequentIn(w)
+}
+
+func (s *journal) TopN(n int, f Filter) ([]Entry, error) {
+	return s.mem.TopN(n, f)
+}
+
+// Compact compacts the counts, then writes a checkpoint of them which replaces the log.
+//
+// The compaction itself isn't logged: after a crash, the hits of the log are compacted again by the next compaction.
+func (s *journal) Compact(now time.Time, r Retention) error {
+	if err := s.mem.Compact(now, r); err != nil {
+		return err
+	}
+	return s.checkpoint()
+}
+
+// checkpoint writes a checkpoint of the counts, if there are new records. The increments are appended to a new log
+// from then on, and the previous logs and checkpoint are removed once the checkpoint is written.
+func (s *journal) checkpoint() error {
+	s.checkpointing.Lock()
+	defer s.checkpointing.Unlock()
+
+	// Switch to a new log, the checkpoint holding exactly the hits of the previous ones
+	s.mu.Lock()
+	if s.f == nil {
+		s.mu.Unlock()
+		return os.ErrClosed
+	}
+	if s.records == 0 {
+		s.mu.Unlock()
+		return nil
+	}
+	f, err := os.OpenFile(s.path(s.gen+1, logExt), os.O_WRONLY|os.O_APPEND|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	var sn bytes.Buffer
+	s.mem.Snapshot(&sn) // cannot fail
+	old, gen := s.f, s.gen
+	s.f, s.gen, s.size, s.records = f, s.gen+1, 0, 0
+	s.mu.Unlock()
+
+	// The previous logs are kept until the checkpoint is written, so that they are replayed if it fails
+	if err := old.Close(); err != nil {
+		return err
+	}
+	if err := writeAtomic(s.path(gen, checkpointExt), func(w io.Writer) error {
+		_, err := w.Write(sn.Bytes())
+		return err
+	}); err != nil {
+		return err
+	}
+	// Make sure the checkpoint is renamed on disk before removing the logs
+	if err := syncDir(s.dir); err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if g, ok := parseGen(e.Name(), logExt); ok && g <= gen {
+			err = errors.Join(err, os.Remove(s.path(g, logExt)))
+		} else if g, ok := parseGen(e.Name(), checkpointExt); ok && g < gen {
+			err = errors.Join(err, os.Remove(s.path(g, checkpointExt)))
+		}
+	}
+	return err
+}
+
+// syncDir commits the entries of the directory to disk.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// Close writes a last checkpoint and closes the log.
+func (s *journal) Close() error {
+	s.closeOnce.Do(func() {
+		err := s.checkpoint()
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.closeErr = errors.Join(err, s.f.Close())
+		s.f = nil
+	})
+	return s.closeErr
+}
@@ -1,30 +1,152 @@
 package stats
 
 import (
+	"io"
+	"math"
 	"sync"
+	"time"
 
 	"github.com/xpetit/fizzbuzz/v5"
 )
 
 type memory struct {
-	m  map[fizzbuzz.Config]int
-	mu sync.RWMutex
+	hitCounts
+	mu sync.RWMutex // mu protects hitCounts
 }
 
 // Memory holds a protected (thread safe) hit count.
 func Memory() *memory {
-	return &memory{
-		m: map[fizzbuzz.Config]int{},
-	}
+	return &memory{hitCounts: newHitCounts()}
 }
 
 func (s *memory) Increment(cfg fizzbuzz.Config) error {
+	s.hit(hit{currentMinute(), cfg})
+	return nil
+}
+
+// hit counts a hit in the lifetime count and in the bucket of its minute.
+func (s *memory) hit(h hit) {
 	s.mu.Lock()
-	s.m[cfg]++
+	s.hitCounts.hit(h)
 	s.mu.Unlock()
-	return nil
 }
 
+// hitCounts holds the lifetime hit counts with the most frequent config, and the buckets of the time windows.
+// It isn't protected: memory and sharded lock it.
+//
+// The hits of the last minute of a config are counted along with its lifetime count, so that an increment only
+// writes one map. They are moved to the buckets when the config is hit in another minute, or before a compaction.
+type hitCounts struct {
+	m       map[fizzbuzz.Config]tally
+	buckets buckets
+
+	// count and cfg are the most frequent config, kept up to date by add and hit
+	count int
+	cfg   fizzbuzz.Config
+}
+
+// tally is the hit count of a config.
+type tally struct {
+	count  int   // count is the lifetime count
+	minute int64 // minute is the start of the minute bucket of recent
+	recent int   // recent is the number of hits in minute that aren't in the buckets
+}
+
+func newHitCounts() hitCounts {
+	return hitCounts{
+		m:       map[fizzbuzz.Config]tally{},
+		buckets: buckets{},
+	}
+}
+
+// add adds count hits to the lifetime count of cfg.
+func (c *hitCounts) add(cfg fizzbuzz.Config, count int) {
+	t := c.m[cfg]
+	t.count += count
+	c.m[cfg] = t
+	c.update(cfg, t.count)
+}
+
+// hit counts a hit in the lifetime count and in the bucket of its minute.
+func (c *hitCounts) hit(h hit) {
+	t := c.m[h.cfg]
+	t.count++
+	if t.minute != h.minute {
+		if t.recent > 0 {
+			c.buckets.add(bucket{t.minute, minute}, h.cfg, t.recent)
+		}
+		t.minute, t.recent = h.minute, 0
+	}
+	t.recent++
+	c.m[h.cfg] = t
+	c.update(h.cfg, t.count)
+}
+
+// update updates the most frequent config with the lifetime count of cfg.
+func (c *hitCounts) update(cfg fizzbuzz.Config, count int) {
+	// The counts only grow, so a config can only become the most frequent one when it is incremented
+	if count > c.count || count == c.count && smaller(cfg, c.cfg) {
+		c.count = count
+		c.cfg = cfg
+	}
+}
+
+// addCounts adds the hit counts in the window to counts.
+func (c *hitCounts) addCounts(counts map[fizzbuzz.Config]int, w Window) {
+	c.buckets.addCounts(counts, w)
+	since, until := w.bounds()
+	for cfg, t := range c.m {
+		if t.recent > 0 && t.minute >= since && t.minute < until {
+			counts[cfg] += t.recent
+		}
+	}
+}
+
+// compact moves the hits of the minutes to compact to the buckets, then compacts them.
+func (c *hitCounts) compact(now time.Time, r Retention) {
+	cutoff := int64(math.MinInt64)
+	for _, st := range r.stages(now) {
+		if st.cutoff > cutoff {
+			cutoff = st.cutoff
+		}
+	}
+	for cfg, t := range c.m {
+		if t.recent > 0 && t.minute+minute <= cutoff {
+			c.buckets.add(bucket{t.minute, minute}, cfg, t.recent)
+			t.recent = 0
+			c.m[cfg] = t
+		}
+	}
+	c.buckets.compact(now, r)
+}
+
+// appendMatches appends the lifetime counts of the configs matching f.
+func (c *hitCounts) appendMatches(entries []Entry, f Filter) []Entry {
+	for cfg, t := range c.m {
+		if f.Match(cfg) {
+			entries = append(entries, Entry{Count: t.count, Config: cfg})
+		}
+	}
+	return entries
+}
+
+// addTo adds the hit counts to the snapshot.
+func (c *hitCounts) addTo(sn *snapshot) {
+	for cfg, t := range c.m {
+		sn.counts[cfg] += t.count
+		if t.recent > 0 {
+			sn.buckets.add(bucket{t.minute, minute}, cfg, t.recent)
+		}
+	}
+	for key, hits := range c.buckets {
+		for cfg, count := range hits {
+			sn.buckets.add(key, cfg, count)
+		}
+	}
+}
+
+// smaller is the order used to differentiate the configs with the same count,
+// so that the most frequent one doesn't depend on the (unspecified) iteration order over maps.
 func smaller(a, b fizzbuzz.Config) bool {
 	if a.Limit != b.Limit {
 		return a.Limit < b.Limit
@@ -43,13 +165,61 @@ func smaller(a, b fizzbuzz.Config) bool {
 
 func (s *memory) MostFrequent() (count int, cfg fizzbuzz.Config, err error) {
 	s.mu.RLock()
-	for config, c := range s.m {
-		// the configs with same count are differentiated because the "iteration order over maps is not specified" (Go spec)
-		if c > count || c == count && smaller(config, cfg) {
-			count = c
-			cfg = config
-		}
-	}
+	count, cfg = s.count, s.cfg
+	s.mu.RUnlock()
+	return
+}
+
+func (s *memory) MostFrequentIn(w Window) (count int, cfg fizzbuzz.Config, err error) {
+	counts := map[fizzbuzz.Config]int{}
+	s.mu.RLock()
+	s.addCounts(counts, w)
 	s.mu.RUnlock()
+	count, cfg = mostFrequentOf(counts)
 	return
 }
+
+func (s *memory) Compact(now time.Time, r Retention) error {
+	s.mu.Lock()
+	s.compact(now, r)
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *memory) TopN(n int, f Filter) ([]Entry, error) {
+	s.mu.RLock()
+	entries := s.appendMatches(nil, f)
+	s.mu.RUnlock()
+	return sortTop(entries, n), nil
+}
+
+func (s *memory) Snapshot(w io.Writer) error {
+	sn := snapshot{map[fizzbuzz.Config]int{}, buckets{}}
+	s.mu.RLock()
+	s.addTo(&sn)
+	s.mu.RUnlock()
+	_, err := w.Write(sn.encode())
+	return err
+}
+
+func (s *memory) Restore(r io.Reader) error {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	sn, err := decodeSnapshot(b)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	for cfg, count := range sn.counts {
+		s.add(cfg, count)
+	}
+	for key, hits := range sn.buckets {
+		for cfg, count := range hits {
+			s.buckets.add(key, cfg, count)
+		}
+	}
+	s.mu.Unlock()
+	return nil
+}
@@ -0,0 +1,213 @@
+package stats
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"strings"
+	"time"
+)
+
+// ErrSchemaTooNew is returned when the schema of a database was migrated by a more recent version of the program.
+var ErrSchemaTooNew = errors.New("database schema more recent than the known migrations")
+
+// Migration is a change of the schema of the SQLite database of OpenDB.
+type Migration struct {
+	Version  int    // Version is the version of the schema once the migration is applied, from 1
+	Name     string // Name describes the change
+	up, down string
+}
+
+// migrations are the changes of the schema, in order: the version of migrations[i] is i+1.
+//
+// The first ones create their tables only if they don't exist, so that the databases created before the migrations
+// (without "schema_version" table) are upgraded without losing their hits.
+var migrations = []Migration{
+	{
+		Version: 1,
+		Name:    "create the stat table",
+		up: `
+			create table if not exists "stat" (
+				"limit" integer not null,
+				"int1"  integer not null,
+				"int2"  integer not null,
+				"str1"  text    not null,
+				"str2"  text    not null,
+				"count" integer not null,
+				primary key (
+					"limit",
+					"int1",
+					"int2",
+					"str1",
+					"str2"
+				)
+			) strict, without rowid;
+			create index if not exists "idx_stat_count" on "stat" ("count");
+		`,
+		down: `
+			drop table "stat";
+		`,
+	},
+	{
+		Version: 2,
+		Name:    "create the stat_bucket table of the time windows",
+		up: `
+			create table if not exists "stat_bucket" (
+				"start" integer not null, -- Unix seconds
+				"size"  integer not null, -- seconds
+				"limit" integer not null,
+				"int1"  integer not null,
+				"int2"  integer not null,
+				"str1"  text    not null,
+				"str2"  text    not null,
+				"count" integer not null,
+				primary key (
+					"start",
+					"size",
+					"limit",
+					"int1",
+					"int2",
+					"str1",
+					"str2"
+				)
+			) strict, without rowid;
+		`,
+		down: `
+			drop table "stat_bucket";
+		`,
+	},
+}
+
+// Migrations returns the migrations of the schema of the SQLite database, in order.
+func Migrations() []Migration {
+	return append([]Migration(nil), migrations...)
+}
+
+// SchemaVersion returns the version of the schema of the SQLite database, 0 if no migration has been applied
+// or if the database file doesn't exist. The database is opened read-only, so that it isn't changed
+// (the -wal and -shm files of a database in WAL mode may be created, as by any reader).
+func SchemaVersion(ctx context.Context, dataSourceName string) (version int, err error) {
+	uri := dataSourceName
+	if !strings.HasPrefix(uri, "file:") {
+		if _, err := os.Stat(dataSourceName); errors.Is(err, fs.ErrNotExist) {
+			return 0, nil
+		}
+		uri = "file:" + strings.NewReplacer("%", "%25", "?", "%3f", "#", "%23").Replace(dataSourceName)
+	}
+	if strings.Contains(uri, "?") {
+		uri += "&mode=ro"
+	} else {
+		uri += "?mode=ro"
+	}
+	// Without the settings of openSQLite: setting the WAL journal mode writes to the database
+	db, err := sql.Open("sqlite3", uri)
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+
+	var exists bool
+	if err := db.QueryRowContext(ctx, `
+		select
+			count(*) > 0
+		from
+			"sqlite_master"
+		where
+			"type" = 'table' and
+			"name" = 'schema_version';
+	`).Scan(&exists); err != nil || !exists {
+		return 0, err
+	}
+	err = db.QueryRowContext(ctx, `
+		select
+			coalesce(max("version"), 0)
+		from
+			"schema_version";
+	`).Scan(&version)
+	return
+}
+
+// MigrateDB applies or reverts migrations in one transaction, so that the schema of the SQLite database is at version.
+// Reverting a migration drops its tables with their hits. OpenDB applies all the migrations.
+func MigrateDB(ctx context.Context, dataSourceName string, version int) error {
+	if version < 0 || version > len(migrations) {
+		return fmt.Errorf("invalid schema version %d: must be between 0 and %d", version, len(migrations))
+	}
+	db, err := openSQLite(ctx, dataSourceName)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return migrate(ctx, db, version)
+}
+
+// schemaVersion creates the table of the applied migrations if it doesn't exist, and returns the last one, in tx.
+func schemaVersion(ctx context.Context, tx *sql.Tx) (version int, err error) {
+	if _, err := tx.ExecContext(ctx, `
+		create table if not exists "schema_version" (
+			"version" integer not null primary key,
+			"applied" integer not null -- Unix seconds
+		) strict;
+	`); err != nil {
+		return 0, err
+	}
+	err = tx.QueryRowContext(ctx, `
+		select
+			coalesce(max("version"), 0)
+		from
+			"schema_version";
+	`).Scan(&version)
+	return
+}
+
+// migrate applies or reverts the migrations in one transaction, so that the schema is at version.
+func migrate(ctx context.Context, db *sql.DB, version int) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	current, err := schemaVersion(ctx, tx)
+	if err != nil {
+		return err
+	}
+	if current > len(migrations) {
+		return fmt.Errorf("%w: version %d, the last migration being %d", ErrSchemaTooNew, current, len(migrations))
+	}
+	for ; current < version; current++ {
+		m := migrations[current]
+		if _, err := tx.ExecContext(ctx, m.up); err != nil {
+			return fmt.Errorf("migration %d (%s): %w", m.Version, m.Name, err)
+		}
+		if _, err := tx.ExecContext(ctx, `
+			insert into "schema_version" (
+				"version",
+				"applied"
+			) values (
+				?, -- version
+				?  -- applied
+			);
+		`, m.Version, time.Now().Unix()); err != nil {
+			return err
+		}
+	}
+	for ; current > version; current-- {
+		m := migrations[current-1]
+		if _, err := tx.ExecContext(ctx, m.down); err != nil {
+			return fmt.Errorf("revert migration %d (%s): %w", m.Version, m.Name, err)
+		}
+		if _, err := tx.ExecContext(ctx, `
+			delete from
+				"schema_version"
+			where
+				"version" = ?;
+		`, m.Version); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
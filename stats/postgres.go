@@ -0,0 +1,500 @@
+package stats
+
+import (
+	"context"
+	"database/sql"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	_ "github.com/lib/pq"
+
+	"github.com/xpetit/fizzbuzz/v5"
+)
+
+// postgresCompactLock is the key of the advisory lock held by the compactions,
+// so that two clients sharing the database don't move the same buckets.
+const postgresCompactLock = 0x66697a7a62757a7a // "fizzbuzz"
+
+// postgresSchemaLock is the key of the advisory lock held while the tables are created,
+// so that two clients starting together don't create the same ones (create if not exists isn't safe concurrently).
+const postgresSchemaLock = postgresCompactLock + 1
+
+type postgres struct {
+	db              *sql.DB
+	increment       *sql.Stmt
+	incrementBucket *sql.Stmt
+	mostFrequent    *sql.Stmt
+	mostFrequentIn  *sql.Stmt
+	compactBuckets  *sql.Stmt
+	deleteBuckets   *sql.Stmt
+}
+
+// OpenPostgres opens a PostgreSQL database holding a persistent and protected (thread safe) hit count,
+// shared by all the clients of the database, ctx being only used to open it.
+// The data source name is a postgres:// URL or a list of key=value settings (see github.com/lib/pq).
+// It must be closed when it is no longer needed.
+//
+// The strings are stored as bytea, so that any string is accepted and ordered bytewise, like the other services.
+func OpenPostgres(ctx context.Context, dataSourceName string) (*postgres, error) {
+	db := &postgres{}
+	var err error
+
+	db.db, err = sql.Open("postgres", dataSourceName)
+	if err != nil {
+		return nil, err
+	}
+
+	// Initialize database
+	if err := db.createTables(ctx); err != nil {
+		db.db.Close()
+		return nil, err
+	}
+
+	// Prepare statements
+	for _, stmt := range []struct {
+		stmt  **sql.Stmt
+		query string
+	}{
+		{&db.increment, `
+			insert into "stat" (
+				"limit",
+				"int1",
+				"int2",
+				"str1",
+				"str2",
+				"count"
+			) values (
+				$1, -- limit
+				$2, -- int1
+				$3, -- int2
+				$4, -- str1
+				$5, -- str2
+				$6  -- count
+			) on conflict (
+				"limit",
+				"int1",
+				"int2",
+				"str1",
+				"str2"
+			) do update set
+				"count" = "stat"."count" + excluded."count";
+		`},
+		{&db.incrementBucket, `
+			insert into "stat_bucket" (
+				"start",
+				"size",
+				"limit",
+				"int1",
+				"int2",
+				"str1",
+				"str2",
+				"count"
+			) values (
+				$1, -- start
+				60, -- size
+				$2, -- limit
+				$3, -- int1
+				$4, -- int2
+				$5, -- str1
+				$6, -- str2
+				$7  -- count
+			) on conflict (
+				"start",
+				"size",
+				"limit",
+				"int1",
+				"int2",
+				"str1",
+				"str2"
+			) do update set
+				"count" = "stat_bucket"."count" + excluded."count";
+		`},
+		{&db.mostFrequent, `
+			select
+				"limit",
+				"int1",
+				"int2",
+				"str1",
+				"str2",
+				"count"
+			from
+				"stat"
+			order by
+				"count" desc,
+				"limit",
+				"int1",
+				"int2",
+				"str1",
+				"str2"
+			limit 1;
+		`},
+		{&db.mostFrequentIn, `
+			select
+				"limit",
+				"int1",
+				"int2",
+				"str1",
+				"str2",
+				sum("count")::bigint as "total"
+			from
+				"stat_bucket"
+			where
+				"start" >= $1 and
+				"start" <  $2
+			group by
+				"limit",
+				"int1",
+				"int2",
+				"str1",
+				"str2"
+			order by
+				"total" desc,
+				"limit",
+				"int1",
+				"int2",
+				"str1",
+				"str2"
+			limit 1;
+		`},
+		{&db.compactBuckets, `
+			insert into "stat_bucket" (
+				"start",
+				"size",
+				"limit",
+				"int1",
+				"int2",
+				"str1",
+				"str2",
+				"count"
+			) select
+				"start" - "start" % $1::bigint,
+				$1::bigint,
+				"limit",
+				"int1",
+				"int2",
+				"str1",
+				"str2",
+				sum("count")::bigint -- sum returns a numeric
+			from
+				"stat_bucket"
+			where
+				"size" < $1::bigint and
+				"start" + "size" <= $2::bigint
+			group by
+				1,
+				"limit",
+				"int1",
+				"int2",
+				"str1",
+				"str2"
+			on conflict (
+				"start",
+				"size",
+				"limit",
+				"int1",
+				"int2",
+				"str1",
+				"str2"
+			) do update set
+				"count" = "stat_bucket"."count" + excluded."count";
+		`},
+		{&db.deleteBuckets, `
+			delete from
+				"stat_bucket"
+			where
+				"size" < $1::bigint and
+				"start" + "size" <= $2::bigint;
+		`},
+	} {
+		if *stmt.stmt, err = db.db.PrepareContext(ctx, stmt.query); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+
+	return db, nil
+}
+
+// createTables creates the tables if they don't exist, in a transaction holding the schema lock.
+func (s *postgres) createTables(ctx context.Context) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// The lock is released by the end of the transaction
+	if _, err := tx.ExecContext(ctx, `select pg_advisory_xact_lock($1);`, int64(postgresSchemaLock)); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `
+		create table if not exists "stat" (
+			"limit" bigint not null,
+			"int1"  bigint not null,
+			"int2"  bigint not null,
+			"str1"  bytea  not null,
+			"str2"  bytea  not null,
+			"count" bigint not null,
+			primary key (
+				"limit",
+				"int1",
+				"int2",
+				"str1",
+				"str2"
+			)
+		);
+		create index if not exists "idx_stat_count" on "stat" ("count");
+		create table if not exists "stat_bucket" (
+			"start" bigint not null, -- Unix seconds
+			"size"  bigint not null, -- seconds
+			"limit" bigint not null,
+			"int1"  bigint not null,
+			"int2"  bigint not null,
+			"str1"  bytea  not null,
+			"str2"  bytea  not null,
+			"count" bigint not null,
+			primary key (
+				"start",
+				"size",
+				"limit",
+				"int1",
+				"int2",
+				"str1",
+				"str2"
+			)
+		);
+	`); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *postgres) Increment(cfg fizzbuzz.Config) error {
+	return s.IncrementContext(context.Background(), cfg)
+}
+
+func (s *postgres) IncrementContext(ctx context.Context, cfg fizzbuzz.Config) error {
+	return s.add(ctx, map[hit]int{{minuteOf(time.Now()), cfg}: 1})
+}
+
+// add adds the hits to the lifetime and bucket counts, in one transaction.
+// The rows are updated in the order of the configs, so that concurrent transactions don't deadlock.
+func (s *postgres) add(ctx context.Context, hits map[hit]int) error {
+	sorted := make([]hit, 0, len(hits))
+	for h := range hits {
+		sorted = append(sorted, h)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		a, b := sorted[i], sorted[j]
+		if a.cfg != b.cfg {
+			return smaller(a.cfg, b.cfg)
+		}
+		return a.minute < b.minute
+	})
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	increment := tx.StmtContext(ctx, s.increment)
+	incrementBucket := tx.StmtContext(ctx, s.incrementBucket)
+	for _, h := range sorted {
+		count := hits[h]
+		if _, err := increment.ExecContext(ctx,
+			h.cfg.Limit,
+			h.cfg.Int1,
+			h.cfg.Int2,
+			[]byte(h.cfg.Str1),
+			[]byte(h.cfg.Str2),
+			count,
+		); err != nil {
+			return err
+		}
+		if _, err := incrementBucket.ExecContext(ctx,
+			h.minute,
+			h.cfg.Limit,
+			h.cfg.Int1,
+			h.cfg.Int2,
+			[]byte(h.cfg.Str1),
+			[]byte(h.cfg.Str2),
+			count,
+		); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *postgres) MostFrequent() (count int, cfg fizzbuzz.Config, err error) {
+	return s.MostFrequentContext(context.Background())
+}
+
+func (s *postgres) MostFrequentContext(ctx context.Context) (count int, cfg fizzbuzz.Config, err error) {
+	return s.queryMostFrequent(ctx, s.mostFrequent)
+}
+
+func (s *postgres) MostFrequentIn(w Window) (count int, cfg fizzbuzz.Config, err error) {
+	return s.MostFrequentInContext(context.Background(), w)
+}
+
+func (s *postgres) MostFrequentInContext(ctx context.Context, w Window) (count int, cfg fizzbuzz.Config, err error) {
+	since, until := w.bounds()
+	return s.queryMostFrequent(ctx, s.mostFrequentIn, since, until)
+}
+
+// queryMostFrequent runs a statement returning the most frequent config.
+func (s *postgres) queryMostFrequent(ctx context.Context, stmt *sql.Stmt, args ...any) (count int, cfg fizzbuzz.Config, err error) {
+	err = stmt.QueryRowContext(ctx, args...).Scan(
+		&cfg.Limit,
+		&cfg.Int1,
+		&cfg.Int2,
+		&cfg.Str1,
+		&cfg.Str2,
+		&count,
+	)
+	if err == sql.ErrNoRows {
+		return 0, cfg, nil
+	}
+	return
+}
+
+func (s *postgres) Compact(now time.Time, r Retention) error {
+	return s.CompactContext(context.Background(), now, r)
+}
+
+// CompactContext runs the stages of the compaction in one transaction, one client at a time.
+func (s *postgres) CompactContext(ctx context.Context, now time.Time, r Retention) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// The lock is released by the end of the transaction
+	if _, err := tx.ExecContext(ctx, `select pg_advisory_xact_lock($1);`, int64(postgresCompactLock)); err != nil {
+		return err
+	}
+	for _, st := range r.stages(now) {
+		size := st.size
+		if size == 0 {
+			size = math.MaxInt64 // drop the buckets of any size
+		} else if _, err := tx.StmtContext(ctx, s.compactBuckets).ExecContext(ctx, size, st.cutoff); err != nil {
+			return err
+		}
+		if _, err := tx.StmtContext(ctx, s.deleteBuckets).ExecContext(ctx, size, st.cutoff); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *postgres) TopN(n int, f Filter) ([]Entry, error) {
+	return s.TopNContext(context.Background(), n, f)
+}
+
+// TopNContext runs the TopN query, the ordering being the same as the one of the other services.
+func (s *postgres) TopNContext(ctx context.Context, n int, f Filter) ([]Entry, error) {
+	var where []string
+	var args []any
+	arg := func(value any) string {
+		args = append(args, value)
+		return "$" + strconv.Itoa(len(args))
+	}
+	for _, c := range []struct {
+		cond  string
+		value *int
+	}{
+		{`"limit" >= `, f.MinLimit},
+		{`"limit" <= `, f.MaxLimit},
+		{`"int1" = `, f.Int1},
+		{`"int2" = `, f.Int2},
+	} {
+		if c.value != nil {
+			where = append(where, c.cond+arg(*c.value))
+		}
+	}
+	for _, c := range []struct {
+		column string
+		prefix string
+	}{
+		{`"str1"`, f.Str1Prefix},
+		{`"str2"`, f.Str2Prefix},
+	} {
+		if c.prefix != "" {
+			p := arg([]byte(c.prefix))
+			where = append(where, `substr(`+c.column+`, 1, length(`+p+`::bytea)) = `+p+`::bytea`)
+		}
+	}
+	query := `
+		select
+			"limit",
+			"int1",
+			"int2",
+			"str1",
+			"str2",
+			"count"
+		from
+			"stat"`
+	if len(where) > 0 {
+		query += `
+		where
+			` + strings.Join(where, " and\n\t\t\t")
+	}
+	query += `
+		order by
+			"count" desc,
+			"limit",
+			"int1",
+			"int2",
+			"str1",
+			"str2"
+		limit ` + arg(n) + `;
+	`
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var entries []Entry
+	for rows.Next() {
+		var e Entry
+		if err := rows.Scan(
+			&e.Config.Limit,
+			&e.Config.Int1,
+			&e.Config.Int2,
+			&e.Config.Str1,
+			&e.Config.Str2,
+			&e.Count,
+		); err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+func (s *postgres) Close() error {
+	stmts := []*sql.Stmt{
+		s.increment,
+		s.incrementBucket,
+		s.mostFrequent,
+		s.mostFrequentIn,
+		s.compactBuckets,
+		s.deleteBuckets,
+	}
+	for _, stmt := range stmts {
+		if stmt == nil {
+			continue // not prepared, OpenPostgres failed
+		}
+		if err := stmt.Close(); err != nil {
+			return err
+		}
+	}
+	return s.db.Close()
+}
@@ -0,0 +1,390 @@
+package stats
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/xpetit/fizzbuzz/v5"
+)
+
+// The keys of the Redis stats
+const (
+	redisStats   = "fizzbuzz:stats"   // redisStats is the sorted set of the lifetime counts
+	redisBuckets = "fizzbuzz:buckets" // redisBuckets is the sorted set of the buckets ("size:start"), scored by start
+	redisBucket  = "fizzbuzz:bucket:" // redisBucket prefixes the sorted sets of the bucket counts
+	redisCompact = "fizzbuzz:compact" // redisCompact is the lock of the compaction
+)
+
+// RedisUnlockScript is the Lua script run with EVAL to release the lock of the compaction: it deletes the lock KEYS[1]
+// if it still holds the token ARGV[1], so that a client whose lock expired doesn't delete the lock taken since by
+// another one. It is exported for the servers that restrict the scripts they run (and for redistest).
+const RedisUnlockScript = `if redis.call("get", KEYS[1]) == ARGV[1] then return redis.call("del", KEYS[1]) else return 0 end`
+
+// redisCompactAttempts is the number of attempts of a stage of the compaction, aborted by the hits added meanwhile.
+const redisCompactAttempts = 10
+
+// redisPage is the number of members read at once by TopN.
+const redisPage = 1000
+
+type redis struct {
+	client *respClient
+}
+
+// OpenRedis connects to a Redis server holding a persistent and protected (thread safe) hit count,
+// shared by all the clients of the server. The URL has the form redis://[[user]:password@]host[:port][/database].
+// ctx is only used to check the connection. It must be closed when it is no longer needed.
+//
+// The configs are the members of sorted sets, scored by their hit count.
+func OpenRedis(ctx context.Context, rawURL string) (*redis, error) {
+	client, err := newRESPClient(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := client.do(ctx, []string{"PING"}); err != nil {
+		client.Close()
+		return nil, err
+	}
+	return &redis{client}, nil
+}
+
+// encodeMember encodes cfg so that the bytewise order of the members, used by Redis for the equal scores,
+// is the order of smaller: the ints are big-endian with the sign bit flipped, and the strings end with
+// "\x00\x01", their zero bytes being escaped as "\x00\xff".
+func encodeMember(cfg fizzbuzz.Config) string {
+	var b []byte
+	for _, i := range []int{cfg.Limit, cfg.Int1, cfg.Int2} {
+		b = binary.BigEndian.AppendUint64(b, uint64(i)^1<<63)
+	}
+	for _, s := range []string{cfg.Str1, cfg.Str2} {
+		b = append(b, strings.ReplaceAll(s, "\x00", "\x00\xff")...)
+		b = append(b, 0, 1)
+	}
+	return string(b)
+}
+
+// decodeMember decodes a member encoded by encodeMember.
+func decodeMember(member string) (cfg fizzbuzz.Config, err error) {
+	invalid := fmt.Errorf("invalid Redis stats member %q", member)
+	if len(member) < 24 {
+		return cfg, invalid
+	}
+	for i, p := range []*int{&cfg.Limit, &cfg.Int1, &cfg.Int2} {
+		*p = int(binary.BigEndian.Uint64([]byte(member[8*i:])) ^ 1<<63)
+	}
+	m := member[24:]
+	for _, p := range []*string{&cfg.Str1, &cfg.Str2} {
+		end := strings.Index(m, "\x00\x01")
+		if end < 0 {
+			return cfg, invalid
+		}
+		*p = strings.ReplaceAll(m[:end], "\x00\xff", "\x00")
+		m = m[end+2:]
+	}
+	if m != "" {
+		return cfg, invalid
+	}
+	return cfg, nil
+}
+
+// bucketMember returns the member of the bucket in redisBuckets, the key of its sorted set being redisBucket+member.
+func bucketMember(b bucket) string {
+	return strconv.FormatInt(b.size, 10) + ":" + strconv.FormatInt(b.start, 10)
+}
+
+func parseBucketMember(m string) (b bucket, err error) {
+	size, start, _ := strings.Cut(m, ":")
+	if b.size, err = strconv.ParseInt(size, 10, 64); err != nil {
+		return
+	}
+	b.start, err = strconv.ParseInt(start, 10, 64)
+	return
+}
+
+// parseEntries parses the reply of a range of a sorted set WITHSCORES.
+func parseEntries(reply any) ([]Entry, error) {
+	elems, _ := reply.([]any)
+	entries := make([]Entry, 0, len(elems)/2)
+	for i := 0; i+1 < len(elems); i += 2 {
+		member, _ := elems[i].(string)
+		score, _ := elems[i+1].(string)
+		cfg, err := decodeMember(member)
+		if err != nil {
+			return nil, err
+		}
+		count, err := strconv.ParseFloat(score, 64)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, Entry{Count: int(count), Config: cfg})
+	}
+	return entries, nil
+}
+
+// formatBound formats a bound of bucket start for ZRANGEBYSCORE, an extreme one being infinite.
+func formatBound(s int64) string {
+	switch s {
+	case math.MinInt64:
+		return "-inf"
+	case math.MaxInt64:
+		return "+inf"
+	}
+	return strconv.FormatInt(s, 10)
+}
+
+func (s *redis) Increment(cfg fizzbuzz.Config) error {
+	return s.IncrementContext(context.Background(), cfg)
+}
+
+func (s *redis) IncrementContext(ctx context.Context, cfg fizzbuzz.Config) error {
+	return s.add(ctx, map[hit]int{{minuteOf(time.Now()), cfg}: 1})
+}
+
+// add adds the hits to the lifetime and bucket counts, in one transaction.
+func (s *redis) add(ctx context.Context, hits map[hit]int) error {
+	cmds := [][]string{{"MULTI"}}
+	for h, count := range hits {
+		member := encodeMember(h.cfg)
+		b := bucketMember(bucket{h.minute, minute})
+		c := strconv.Itoa(count)
+		cmds = append(cmds,
+			[]string{"ZINCRBY", redisStats, c, member},
+			[]string{"ZINCRBY", redisBucket + b, c, member},
+			[]string{"ZADD", redisBuckets, "NX", strconv.FormatInt(h.minute, 10), b},
+		)
+	}
+	cmds = append(cmds, []string{"EXEC"})
+	_, err := s.client.do(ctx, cmds...)
+	return err
+}
+
+func (s *redis) MostFrequent() (count int, cfg fizzbuzz.Config, err error) {
+	return s.MostFrequentContext(context.Background())
+}
+
+func (s *redis) MostFrequentContext(ctx context.Context) (count int, cfg fizzbuzz.Config, err error) {
+	replies, err := s.client.do(ctx, []string{"ZREVRANGE", redisStats, "0", "0", "WITHSCORES"})
+	if err != nil {
+		return 0, cfg, err
+	}
+	top, err := parseEntries(replies[0])
+	if err != nil || len(top) == 0 {
+		return 0, cfg, err
+	}
+	// The smallest config with the top count comes first in the increasing order.
+	// The counts only grow meanwhile, so there is always one with this count or more.
+	score := strconv.Itoa(top[0].Count)
+	replies, err = s.client.do(ctx, []string{"ZRANGEBYSCORE", redisStats, score, "+inf", "WITHSCORES", "LIMIT", "0", "1"})
+	if err != nil {
+		return 0, cfg, err
+	}
+	if top, err = parseEntries(replies[0]); err != nil || len(top) == 0 {
+		return 0, cfg, err
+	}
+	return top[0].Count, top[0].Config, nil
+}
+
+func (s *redis) MostFrequentIn(w Window) (count int, cfg fizzbuzz.Config, err error) {
+	return s.MostFrequentInContext(context.Background(), w)
+}
+
+func (s *redis) MostFrequentInContext(ctx context.Context, w Window) (count int, cfg fizzbuzz.Config, err error) {
+	since, until := w.bounds()
+	replies, err := s.client.do(ctx, []string{"ZRANGEBYSCORE", redisBuckets, formatBound(since), "(" + formatBound(until)})
+	if err != nil {
+		return 0, cfg, err
+	}
+	counts, err := s.bucketCounts(ctx, replies[0])
+	if err != nil {
+		return 0, cfg, err
+	}
+	count, cfg = mostFrequentOf(counts)
+	return
+}
+
+// bucketCounts returns the sum of the counts of the buckets, given by a reply of members of redisBuckets.
+func (s *redis) bucketCounts(ctx context.Context, members any) (map[fizzbuzz.Config]int, error) {
+	elems, _ := members.([]any)
+	cmds := make([][]string, len(elems))
+	for i, elem := range elems {
+		member, _ := elem.(string)
+		cmds[i] = []string{"ZRANGE", redisBucket + member, "0", "-1", "WITHSCORES"}
+	}
+	replies, err := s.client.do(ctx, cmds...)
+	if err != nil {
+		return nil, err
+	}
+	counts := map[fizzbuzz.Config]int{}
+	for _, reply := range replies {
+		entries, err := parseEntries(reply)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			counts[e.Config] += e.Count
+		}
+	}
+	return counts, nil
+}
+
+func (s *redis) TopN(n int, f Filter) ([]Entry, error) {
+	return s.TopNContext(context.Background(), n, f)
+}
+
+// TopNContext reads the configs by decreasing count, one page at a time, until the next ones can't be in the top.
+func (s *redis) TopNContext(ctx context.Context, n int, f Filter) ([]Entry, error) {
+	var entries []Entry
+	for start := 0; ; start += redisPage {
+		replies, err := s.client.do(ctx, []string{
+			"ZREVRANGE", redisStats, strconv.Itoa(start), strconv.Itoa(start + redisPage - 1), "WITHSCORES",
+		})
+		if err != nil {
+			return nil, err
+		}
+		page, err := parseEntries(replies[0])
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range page {
+			if f.Match(e.Config) {
+				entries = append(entries, e)
+			}
+		}
+		// The order of the equal counts is reversed in the page, the entries are sorted again
+		entries = sortTop(entries, n)
+		if len(page) < redisPage ||
+			len(entries) == n && (n == 0 || page[len(page)-1].Count < entries[n-1].Count) {
+			return entries, nil
+		}
+	}
+}
+
+func (s *redis) Compact(now time.Time, r Retention) error {
+	return s.CompactContext(context.Background(), now, r)
+}
+
+// CompactContext runs the stages of the compaction, each one moving the old buckets in one transaction.
+// It is skipped if another client is compacting the stats.
+func (s *redis) CompactContext(ctx context.Context, now time.Time, r Retention) error {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	token := hex.EncodeToString(b)
+	replies, err := s.client.do(ctx, []string{"SET", redisCompact, token, "NX", "PX", "60000"})
+	if err != nil {
+		return err
+	}
+	if replies[0] == nil {
+		return nil // locked by another client
+	}
+	defer func() {
+		// Release the lock even if ctx is done, the lock expiring otherwise
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		s.client.do(ctx, []string{"EVAL", RedisUnlockScript, "1", redisCompact, token})
+	}()
+
+	for _, st := range r.stages(now) {
+		if err := s.compactStage(ctx, st); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// compactStage moves the buckets of the stage into bigger ones, or deletes them.
+func (s *redis) compactStage(ctx context.Context, st stage) error {
+	for i := 0; i < redisCompactAttempts; i++ {
+		var moved bool
+		err := s.client.with(ctx, func(do func(cmds ...[]string) ([]any, error)) (err error) {
+			moved, err = moveBuckets(do, st)
+			return
+		})
+		if err != nil || moved {
+			return err
+		}
+	}
+	return errors.New("redis: the buckets kept changing during the compaction")
+}
+
+// moveBuckets moves the buckets of the stage with the commands of a connection. The buckets are watched while they
+// are read, so that the transaction moving them is aborted if hits are added meanwhile: moved is then false.
+func moveBuckets(do func(cmds ...[]string) ([]any, error), st stage) (moved bool, err error) {
+	replies, err := do([]string{"ZRANGEBYSCORE", redisBuckets, "-inf", "(" + strconv.FormatInt(st.cutoff, 10)})
+	if err != nil {
+		return false, err
+	}
+	var keys []bucket
+	watch := []string{"WATCH"}
+	var reads [][]string
+	elems, _ := replies[0].([]any)
+	for _, elem := range elems {
+		member, _ := elem.(string)
+		key, err := parseBucketMember(member)
+		if err != nil {
+			return false, fmt.Errorf("invalid Redis bucket %q: %w", member, err)
+		}
+		if st.size != 0 && key.size >= st.size || key.start+key.size > st.cutoff {
+			continue
+		}
+		keys = append(keys, key)
+		watch = append(watch, redisBucket+member)
+		reads = append(reads, []string{"ZRANGE", redisBucket + member, "0", "-1", "WITHSCORES"})
+	}
+	if len(keys) == 0 {
+		return true, nil
+	}
+	if st.size == 0 {
+		reads = nil // the buckets are dropped, their counts aren't needed
+	}
+	if replies, err = do(append([][]string{watch}, reads...)...); err != nil {
+		return false, err
+	}
+	replies = replies[1:]
+
+	// Merge the counts before writing them, a merged bucket being written once
+	merged := buckets{}
+	for i, reply := range replies {
+		entries, err := parseEntries(reply)
+		if err != nil {
+			return false, err
+		}
+		key := keys[i]
+		for _, e := range entries {
+			merged.add(bucket{key.start - key.start%st.size, st.size}, e.Config, e.Count)
+		}
+	}
+	cmds := [][]string{{"MULTI"}}
+	for key, m := range merged {
+		b := bucketMember(key)
+		for cfg, count := range m {
+			cmds = append(cmds, []string{"ZINCRBY", redisBucket + b, strconv.Itoa(count), encodeMember(cfg)})
+		}
+		cmds = append(cmds, []string{"ZADD", redisBuckets, "NX", strconv.FormatInt(key.start, 10), b})
+	}
+	for _, key := range keys {
+		b := bucketMember(key)
+		cmds = append(cmds,
+			[]string{"DEL", redisBucket + b},
+			[]string{"ZREM", redisBuckets, b},
+		)
+	}
+	cmds = append(cmds, []string{"EXEC"})
+	if replies, err = do(cmds...); err != nil {
+		return false, err
+	}
+	return replies[len(replies)-1] != nil, nil
+}
+
+// Close closes the idle connections to the server.
+func (s *redis) Close() error {
+	return s.client.Close()
+}
@@ -0,0 +1,469 @@
+// Package redistest provides an in-process stand-in of a Redis server, for the tests of the Redis stats.
+//
+// It speaks RESP2 and only implements the commands used by the stats, with a single database:
+// PING, AUTH, SELECT, DEL, GET, SET (with NX and PX, without expiration), MULTI, EXEC, WATCH, UNWATCH,
+// EVAL (of stats.RedisUnlockScript only), ZADD (with NX), ZINCRBY, ZREM, ZRANGE, ZREVRANGE and ZRANGEBYSCORE
+// (with WITHSCORES and LIMIT).
+package redistest
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/xpetit/fizzbuzz/v5/stats"
+)
+
+// Server is a Redis stand-in listening on a local port.
+type Server struct {
+	URL string // URL is the redis:// URL of the server
+
+	listener net.Listener
+	conns    map[net.Conn]bool
+	accepted int // accepted is the number of connections accepted
+	handlers sync.WaitGroup
+
+	mu       sync.Mutex // mu protects conns, accepted and the data
+	strings  map[string]string
+	zsets    map[string]map[string]float64
+	versions map[string]uint64 // versions counts the writes of each key, for WATCH
+}
+
+// NewServer starts and returns a new Server, which must be closed when it is no longer needed.
+func NewServer() *Server {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(fmt.Sprintf("redistest: failed to listen on a port: %v", err))
+	}
+	s := &Server{
+		URL:      "redis://" + l.Addr().String(),
+		listener: l,
+		conns:    map[net.Conn]bool{},
+		strings:  map[string]string{},
+		zsets:    map[string]map[string]float64{},
+		versions: map[string]uint64{},
+	}
+	go s.serve()
+	return s
+}
+
+// Get returns the value of a string key, and whether it exists.
+func (s *Server) Get(key string) (value string, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	value, ok = s.strings[key]
+	return
+}
+
+// Set sets the value of a string key.
+func (s *Server) Set(key, value string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.exec([]string{"SET", key, value})
+}
+
+// Conns returns the number of open connections, and the number of connections accepted since the start.
+func (s *Server) Conns() (open, accepted int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.conns), s.accepted
+}
+
+// Close stops the server and closes its connections.
+func (s *Server) Close() {
+	s.listener.Close()
+	s.mu.Lock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	s.handlers.Wait()
+}
+
+func (s *Server) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.conns[conn] = true
+		s.accepted++
+		s.mu.Unlock()
+		s.handlers.Add(1)
+		go func() {
+			defer s.handlers.Done()
+			s.handle(conn)
+			s.mu.Lock()
+			delete(s.conns, conn)
+			s.mu.Unlock()
+			conn.Close()
+		}()
+	}
+}
+
+// reply is written with the RESP type of its value: nil, string (bulk), status (simple string), error, int or []reply.
+type reply any
+
+type status string
+
+// handle serves the commands of a connection until it is closed.
+func (s *Server) handle(conn net.Conn) {
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	var queued [][]string         // the commands of a transaction, nil outside of MULTI
+	var watched map[string]uint64 // the versions of the watched keys
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				writeReply(w, fmt.Errorf("ERR %v", err))
+				w.Flush()
+			}
+			return
+		}
+		var rep reply
+		switch name := strings.ToUpper(args[0]); {
+		case name == "MULTI":
+			queued, rep = [][]string{}, status("OK")
+		case name == "EXEC" && queued != nil:
+			replies := make([]reply, len(queued))
+			s.mu.Lock()
+			aborted := false
+			for key, version := range watched {
+				aborted = aborted || s.versions[key] != version
+			}
+			if !aborted {
+				for i, cmd := range queued {
+					replies[i] = s.exec(cmd)
+				}
+				rep = replies
+			}
+			s.mu.Unlock()
+			queued, watched = nil, nil // an aborted transaction replies nil
+		case queued != nil:
+			queued, rep = append(queued, args), status("QUEUED")
+		case name == "WATCH" && len(args) > 1:
+			if watched == nil {
+				watched = map[string]uint64{}
+			}
+			s.mu.Lock()
+			for _, key := range args[1:] {
+				watched[key] = s.versions[key]
+			}
+			s.mu.Unlock()
+			rep = status("OK")
+		case name == "UNWATCH":
+			watched, rep = nil, status("OK")
+		default:
+			s.mu.Lock()
+			rep = s.exec(args)
+			s.mu.Unlock()
+		}
+		writeReply(w, rep)
+		// Flush once all the pipelined commands are answered
+		if r.Buffered() == 0 {
+			if err := w.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "*") {
+		return nil, errors.New("protocol error: expected an array")
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil || n < 1 {
+		return nil, errors.New("protocol error: invalid array size")
+	}
+	args := make([]string, n)
+	for i := range args {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		if !strings.HasPrefix(line, "$") {
+			return nil, errors.New("protocol error: expected a bulk string")
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+		if err != nil || size < 0 {
+			return nil, errors.New("protocol error: invalid bulk size")
+		}
+		b := make([]byte, size+2)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		args[i] = string(b[:size])
+	}
+	return args, nil
+}
+
+func writeReply(w *bufio.Writer, rep reply) {
+	switch v := rep.(type) {
+	case nil:
+		w.WriteString("$-1\r\n")
+	case status:
+		fmt.Fprintf(w, "+%s\r\n", v)
+	case error:
+		fmt.Fprintf(w, "-%s\r\n", v)
+	case int:
+		fmt.Fprintf(w, ":%d\r\n", v)
+	case string:
+		fmt.Fprintf(w, "$%d\r\n%s\r\n", len(v), v)
+	case []reply:
+		fmt.Fprintf(w, "*%d\r\n", len(v))
+		for _, r := range v {
+			writeReply(w, r)
+		}
+	}
+}
+
+var errSyntax = errors.New("ERR syntax error")
+
+// exec executes a command, s.mu being locked.
+func (s *Server) exec(args []string) reply {
+	name, args := strings.ToUpper(args[0]), args[1:]
+	arity := map[string]int{
+		"PING": 0, "AUTH": 1, "SELECT": 1, "DEL": 1, "GET": 1, "SET": 2, "EVAL": 2,
+		"ZADD": 3, "ZINCRBY": 3, "ZREM": 2, "ZRANGE": 3, "ZREVRANGE": 3, "ZRANGEBYSCORE": 3,
+	}
+	if n, ok := arity[name]; !ok {
+		return fmt.Errorf("ERR unknown command '%s'", name)
+	} else if len(args) < n {
+		return fmt.Errorf("ERR wrong number of arguments for '%s' command", name)
+	}
+
+	// The written keys are changed for the transactions watching them, even if their value doesn't change
+	switch name {
+	case "DEL":
+		for _, key := range args {
+			s.versions[key]++
+		}
+	case "SET", "ZADD", "ZINCRBY", "ZREM":
+		s.versions[args[0]]++
+	}
+
+	switch name {
+	case "PING":
+		return status("PONG")
+	case "AUTH", "SELECT":
+		return status("OK")
+	case "DEL":
+		var n int
+		for _, key := range args {
+			if _, ok := s.strings[key]; ok {
+				n++
+			} else if _, ok := s.zsets[key]; ok {
+				n++
+			}
+			delete(s.strings, key)
+			delete(s.zsets, key)
+		}
+		return n
+	case "GET":
+		if value, ok := s.strings[args[0]]; ok {
+			return value
+		}
+		return nil
+	case "EVAL":
+		if args[0] != stats.RedisUnlockScript || args[1] != "1" || len(args) != 4 {
+			return errors.New("ERR only the unlock script is supported")
+		}
+		if value, ok := s.strings[args[2]]; ok && value == args[3] {
+			return s.exec([]string{"DEL", args[2]})
+		}
+		return 0
+	case "SET":
+		key, value := args[0], args[1]
+		nx := false
+		for i := 2; i < len(args); i++ {
+			switch strings.ToUpper(args[i]) {
+			case "NX":
+				nx = true
+			case "PX":
+				i++ // the expiration is ignored
+			default:
+				return errSyntax
+			}
+		}
+		if _, ok := s.strings[key]; ok && nx {
+			return nil
+		}
+		s.strings[key] = value
+		return status("OK")
+	case "ZADD", "ZINCRBY":
+		nx := name == "ZADD" && strings.ToUpper(args[1]) == "NX"
+		if nx {
+			args = append(args[:1:1], args[2:]...)
+		}
+		if len(args) != 3 {
+			return errSyntax
+		}
+		score, err := strconv.ParseFloat(args[1], 64)
+		if err != nil {
+			return errors.New("ERR value is not a valid float")
+		}
+		z := s.zsets[args[0]]
+		if z == nil {
+			z = map[string]float64{}
+			s.zsets[args[0]] = z
+		}
+		old, ok := z[args[2]]
+		switch {
+		case name == "ZINCRBY":
+			z[args[2]] = old + score
+			return formatScore(z[args[2]])
+		case ok && nx:
+			return 0
+		default:
+			z[args[2]] = score
+			if ok {
+				return 0
+			}
+			return 1
+		}
+	case "ZREM":
+		var n int
+		z := s.zsets[args[0]]
+		for _, member := range args[1:] {
+			if _, ok := z[member]; ok {
+				delete(z, member)
+				n++
+			}
+		}
+		if len(z) == 0 {
+			delete(s.zsets, args[0])
+		}
+		return n
+	case "ZRANGE", "ZREVRANGE":
+		start, err1 := strconv.Atoi(args[1])
+		stop, err2 := strconv.Atoi(args[2])
+		if err1 != nil || err2 != nil {
+			return errors.New("ERR value is not an integer or out of range")
+		}
+		withScores, err := parseOptions(args[3:], nil)
+		if err != nil {
+			return err
+		}
+		members := s.sorted(args[0], math.Inf(-1), math.Inf(1), false, false, name == "ZREVRANGE")
+		n := len(members)
+		if start < 0 {
+			start += n
+		}
+		if stop < 0 {
+			stop += n
+		}
+		if start < 0 {
+			start = 0
+		}
+		if stop >= n {
+			stop = n - 1
+		}
+		if start > stop {
+			return []reply{}
+		}
+		return s.format(args[0], members[start:stop+1], withScores)
+	case "ZRANGEBYSCORE":
+		lo, loExcl, err1 := parseBound(args[1])
+		hi, hiExcl, err2 := parseBound(args[2])
+		if err1 != nil || err2 != nil {
+			return errors.New("ERR min or max is not a float")
+		}
+		limit := []int{0, -1}
+		withScores, err := parseOptions(args[3:], limit)
+		if err != nil {
+			return err
+		}
+		members := s.sorted(args[0], lo, hi, loExcl, hiExcl, false)
+		if limit[0] > len(members) {
+			limit[0] = len(members)
+		}
+		members = members[limit[0]:]
+		if limit[1] >= 0 && limit[1] < len(members) {
+			members = members[:limit[1]]
+		}
+		return s.format(args[0], members, withScores)
+	}
+	panic("unreachable")
+}
+
+// parseOptions parses the WITHSCORES option, and the LIMIT one into limit if it isn't nil.
+func parseOptions(args []string, limit []int) (withScores bool, err error) {
+	for i := 0; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "WITHSCORES":
+			withScores = true
+		case "LIMIT":
+			if limit == nil || i+2 >= len(args) {
+				return false, errSyntax
+			}
+			for j := range limit {
+				if limit[j], err = strconv.Atoi(args[i+1+j]); err != nil {
+					return false, errSyntax
+				}
+			}
+			i += 2
+		default:
+			return false, errSyntax
+		}
+	}
+	return
+}
+
+// parseBound parses a bound of ZRANGEBYSCORE: a float, -inf or +inf, exclusive if prefixed by "(".
+func parseBound(s string) (bound float64, exclusive bool, err error) {
+	s, exclusive = strings.CutPrefix(s, "(")
+	bound, err = strconv.ParseFloat(s, 64)
+	return
+}
+
+// sorted returns the members of the sorted set whose score is in the range, by score and then bytewise.
+func (s *Server) sorted(key string, lo, hi float64, loExcl, hiExcl, reverse bool) []string {
+	z := s.zsets[key]
+	var members []string
+	for member, score := range z {
+		if score < lo || loExcl && score == lo || score > hi || hiExcl && score == hi {
+			continue
+		}
+		members = append(members, member)
+	}
+	sort.Slice(members, func(i, j int) bool {
+		a, b := members[i], members[j]
+		if reverse {
+			a, b = b, a
+		}
+		if z[a] != z[b] {
+			return z[a] < z[b]
+		}
+		return a < b
+	})
+	return members
+}
+
+func (s *Server) format(key string, members []string, withScores bool) reply {
+	replies := []reply{}
+	for _, member := range members {
+		replies = append(replies, member)
+		if withScores {
+			replies = append(replies, formatScore(s.zsets[key][member]))
+		}
+	}
+	return replies
+}
+
+func formatScore(score float64) string {
+	return strconv.FormatFloat(score, 'g', 17, 64)
+}
@@ -0,0 +1,334 @@
+package stats
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/xpetit/fizzbuzz/v5"
+)
+
+// Mergeable is implemented by the services whose hit counts can be replicated between nodes.
+type Mergeable interface {
+	// Export writes the versions of all the nodes known by the service, and the changes of their states
+	// since the versions of since (their whole states if since is nil).
+	Export(w io.Writer, since map[string]uint64) error
+	// Merge merges the states read from r, written by Export, and returns the versions written with them.
+	Merge(r io.Reader) (versions map[string]uint64, err error)
+}
+
+// nodeState is the hit count of a node, only changed by the node itself.
+// The version of the last change of each count is kept, so that Export only writes the changes since a version.
+type nodeState struct {
+	version uint64 // version is incremented by each change
+	counts  map[fizzbuzz.Config]int
+	buckets buckets
+
+	countVersions map[fizzbuzz.Config]uint64 // countVersions holds the version of the last change of each count
+	hitVersions   map[bucketHit]uint64       // hitVersions holds the version of the last change of each bucket count
+	removed       map[bucket]uint64          // removed holds the version of the removal of the buckets merged by compaction
+}
+
+// bucketHit identifies the hit count of a config in a bucket.
+type bucketHit struct {
+	key bucket
+	cfg fizzbuzz.Config
+}
+
+func newNodeState() *nodeState {
+	return &nodeState{
+		counts:        map[fizzbuzz.Config]int{},
+		buckets:       buckets{},
+		countVersions: map[fizzbuzz.Config]uint64{},
+		hitVersions:   map[bucketHit]uint64{},
+		removed:       map[bucket]uint64{},
+	}
+}
+
+// setCount sets the hit count of cfg in the bucket key, changed in version.
+func (n *nodeState) setCount(key bucket, cfg fizzbuzz.Config, count int, version uint64) {
+	m := n.buckets[key]
+	if m == nil {
+		m = map[fizzbuzz.Config]int{}
+		n.buckets[key] = m
+	}
+	m[cfg] = count
+	n.hitVersions[bucketHit{key, cfg}] = version
+}
+
+// remove removes the bucket key and the smaller ones it covers, which a compaction merged into a bigger bucket,
+// and remembers their removal in version so that it is exported.
+func (n *nodeState) remove(key bucket, version uint64) {
+	n.drop(key)
+	n.removed[key] = version
+}
+
+// drop removes the bucket key and the smaller ones it covers, with their removals,
+// the ones of the buckets it covers being implied by its own.
+func (n *nodeState) drop(key bucket) {
+	for _, size := range []int64{minute, hour, day} {
+		if size > key.size {
+			break
+		}
+		for start := key.start; start < key.start+key.size; start += size {
+			b := bucket{start, size}
+			for cfg := range n.buckets[b] {
+				delete(n.hitVersions, bucketHit{b, cfg})
+			}
+			delete(n.buckets, b)
+			delete(n.removed, b)
+		}
+	}
+}
+
+type replicated struct {
+	id    string
+	nodes map[string]*nodeState
+	total *memory // total holds the sum of the lifetime counts of the nodes (its buckets aren't used)
+	mu    sync.RWMutex
+}
+
+// Replicated holds a protected (thread safe) hit count, replicated between nodes with Export and Merge
+// so that they all converge to the same counts. The id of the node must be unique, and only be reused after a restart
+// if its state is restored, with Restore (a snapshot of all the nodes, whose id is returned by SnapshotNodeID).
+//
+// The lifetime counts are a G-counter (a CRDT): each node only increments its own counts,
+// and the counts of a node are merged by keeping the maximum. The bucket counts of the time windows of a node
+// are replaced by the most recent ones, and the buckets merged by its compactions are removed.
+// Each change is versioned, so that Export only writes the changes since the versions known by the peer.
+func Replicated(id string) *replicated {
+	return &replicated{
+		id:    id,
+		nodes: map[string]*nodeState{id: newNodeState()},
+		total: Memory(),
+	}
+}
+
+func (s *replicated) Increment(cfg fizzbuzz.Config) error {
+	m := currentMinute()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	local := s.nodes[s.id]
+	local.version++
+	local.counts[cfg]++
+	local.countVersions[cfg] = local.version
+	key := bucket{m, minute}
+	local.setCount(key, cfg, local.buckets[key][cfg]+1, local.version)
+	s.addTotal(cfg, 1)
+	return nil
+}
+
+// addTotal adds count hits to the total of cfg, s.mu being locked.
+func (s *replicated) addTotal(cfg fizzbuzz.Config, count int) {
+	s.total.mu.Lock()
+	s.total.add(cfg, count)
+	s.total.mu.Unlock()
+}
+
+func (s *replicated) MostFrequent() (count int, cfg fizzbuzz.Config, err error) {
+	return s.total.MostFrequent()
+}
+
+func (s *replicated) MostFrequentIn(w Window) (count int, cfg fizzbuzz.Config, err error) {
+	counts := map[fizzbuzz.Config]int{}
+	s.mu.RLock()
+	for _, n := range s.nodes {
+		n.buckets.addCounts(counts, w)
+	}
+	s.mu.RUnlock()
+	count, cfg = mostFrequentOf(counts)
+	return
+}
+
+func (s *replicated) TopN(n int, f Filter) ([]Entry, error) {
+	return s.total.TopN(n, f)
+}
+
+// Compact compacts the buckets of this node, and drops the oldest buckets of all the nodes
+// so that the ones that are no longer merged don't grow.
+// The buckets of the other nodes are only compacted by the nodes themselves, their compactions being merged.
+func (s *replicated) Compact(now time.Time, r Retention) error {
+	stages := r.stages(now)
+	cutoff := stages[len(stages)-1].cutoff
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, n := range s.nodes {
+		if id == s.id {
+			version := n.version + 1
+			n.buckets.compactFunc(now, r, func(key bucket, hits map[fizzbuzz.Config]int, into bucket) {
+				for cfg := range hits {
+					delete(n.hitVersions, bucketHit{key, cfg})
+				}
+				n.drop(key)
+				if into.size == 0 {
+					return
+				}
+				n.removed[key] = version
+				for cfg := range hits {
+					n.hitVersions[bucketHit{into, cfg}] = version
+				}
+				n.version = version
+			})
+		}
+		for key := range n.buckets {
+			if key.start+key.size <= cutoff {
+				n.drop(key)
+			}
+		}
+		for key := range n.removed {
+			if key.start+key.size <= cutoff {
+				delete(n.removed, key)
+			}
+		}
+	}
+	return nil
+}
+
+// exported is the format of Export and Snapshot: the node states are encoded like snapshots.
+type exported struct {
+	ID       string            `json:"id,omitempty"` // ID is the id of the exporting node
+	Versions map[string]uint64 `json:"versions"`
+	Nodes    []exportedNode    `json:"nodes"`
+}
+
+// exportedNode holds the changes of the state of a node: the counts that changed, encoded like a snapshot,
+// and the buckets removed by the compactions of the node.
+type exportedNode struct {
+	ID      string           `json:"id"`
+	Version uint64           `json:"version"`
+	State   []byte           `json:"state"`
+	Removed []exportedBucket `json:"removed,omitempty"`
+}
+
+type exportedBucket struct {
+	Start int64 `json:"start"`
+	Size  int64 `json:"size"`
+}
+
+func (s *replicated) Export(w io.Writer, since map[string]uint64) error {
+	e := exported{ID: s.id, Versions: map[string]uint64{}, Nodes: []exportedNode{}}
+	s.mu.RLock()
+	for id, n := range s.nodes {
+		e.Versions[id] = n.version
+		v, ok := since[id]
+		if ok && v >= n.version {
+			continue
+		}
+		sn := snapshot{map[fizzbuzz.Config]int{}, buckets{}}
+		for cfg, version := range n.countVersions {
+			if version > v {
+				sn.counts[cfg] = n.counts[cfg]
+			}
+		}
+		for h, version := range n.hitVersions {
+			if version > v {
+				sn.buckets.add(h.key, h.cfg, n.buckets[h.key][h.cfg])
+				// The buckets refer to the configs of the counts, merged by keeping the maximum
+				sn.counts[h.cfg] = n.counts[h.cfg]
+			}
+		}
+		en := exportedNode{ID: id, Version: n.version, State: sn.encode()}
+		for key, version := range n.removed {
+			if version > v {
+				en.Removed = append(en.Removed, exportedBucket{key.start, key.size})
+			}
+		}
+		e.Nodes = append(e.Nodes, en)
+	}
+	s.mu.RUnlock()
+	return json.NewEncoder(w).Encode(e)
+}
+
+func (s *replicated) Merge(r io.Reader) (versions map[string]uint64, err error) {
+	return s.merge(r, false)
+}
+
+// Snapshot writes the states of all the nodes, like Export.
+func (s *replicated) Snapshot(w io.Writer) error {
+	return s.Export(w, nil)
+}
+
+// Restore merges the states read from r, written by Snapshot, including the state of this node,
+// so it must be called before any increment.
+func (s *replicated) Restore(r io.Reader) error {
+	_, err := s.merge(r, true)
+	if err != nil && !errors.Is(err, ErrCorruptSnapshot) {
+		err = fmt.Errorf("%w: %v", ErrCorruptSnapshot, err)
+	}
+	return err
+}
+
+// SnapshotNodeID returns the id of the node whose snapshot (written by SaveSnapshot of Replicated) is at path,
+// or an empty string if there is no snapshot.
+func SnapshotNodeID(path string) (string, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	var e exported
+	if err := json.NewDecoder(f).Decode(&e); err != nil {
+		return "", fmt.Errorf("%w: %v", ErrCorruptSnapshot, err)
+	}
+	return e.ID, nil
+}
+
+// merge merges the states read from r, the one of this node only if restore is true.
+func (s *replicated) merge(r io.Reader, restore bool) (versions map[string]uint64, err error) {
+	var e exported
+	if err := json.NewDecoder(r).Decode(&e); err != nil {
+		return nil, err
+	}
+	// Decode all the states before merging them, so that an invalid export isn't partially merged
+	states := make(map[string]snapshot, len(e.Nodes))
+	for _, n := range e.Nodes {
+		sn, err := decodeSnapshot(n.State)
+		if err != nil {
+			return nil, fmt.Errorf("state of node %q: %w", n.ID, err)
+		}
+		states[n.ID] = sn
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, en := range e.Nodes {
+		if en.ID == s.id && !restore {
+			continue // a node is the only one to change its state
+		}
+		n := s.nodes[en.ID]
+		if n == nil {
+			n = newNodeState()
+			s.nodes[en.ID] = n
+		}
+		if en.Version <= n.version {
+			continue
+		}
+		// The changes are those since a version known by this node, at most n.version,
+		// so applying them brings the state to en.Version
+		for _, b := range en.Removed {
+			n.remove(bucket{b.Start, b.Size}, en.Version)
+		}
+		sn := states[en.ID]
+		for cfg, count := range sn.counts {
+			if old := n.counts[cfg]; count > old {
+				n.counts[cfg] = count
+				n.countVersions[cfg] = en.Version
+				s.addTotal(cfg, count-old)
+			}
+		}
+		for key, hits := range sn.buckets {
+			for cfg, count := range hits {
+				n.setCount(key, cfg, count, en.Version)
+			}
+		}
+		n.version = en.Version
+	}
+	return e.Versions, nil
+}
@@ -0,0 +1,287 @@
+package stats
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/xpetit/fizzbuzz/v5"
+)
+
+// ErrUnavailable is returned by Resilient when its circuit breaker doesn't let the calls reach the backend.
+var ErrUnavailable = errors.New("stats unavailable: the circuit breaker is open")
+
+// BreakerState is the state of the circuit breaker of Resilient.
+type BreakerState int
+
+const (
+	BreakerClosed   BreakerState = iota // the backend is healthy
+	BreakerOpen                         // the backend is unhealthy: the increments are kept in memory, the other calls fail
+	BreakerHalfOpen                     // the backend is tried again, by replaying the increments kept in memory
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	}
+	return "invalid"
+}
+
+// Breaker is implemented by the services with a circuit breaker.
+type Breaker interface {
+	// State returns the current state of the circuit breaker.
+	State() BreakerState
+}
+
+// adder is implemented by the backends that can add hits of past minutes, in one call.
+type adder interface {
+	add(ctx context.Context, hits map[hit]int) error
+}
+
+// prober is implemented by the backends whose calls can succeed without reaching their database (such as Buffered),
+// probe reaches it.
+type prober interface {
+	probe(ctx context.Context) error
+}
+
+type resilient struct {
+	backend  ContextService
+	timeout  time.Duration
+	failures int
+	cooldown time.Duration
+
+	state    BreakerState
+	failed   int         // failed is the number of consecutive failures, while the breaker is closed
+	openedAt time.Time   // openedAt is the time of the last opening of the breaker
+	pending  map[hit]int // pending holds the increments made while the breaker isn't closed
+	mu       sync.Mutex  // mu protects the fields above
+
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// Resilient protects the calls to backend: each one is limited to timeout, and after the given number of consecutive
+// failures, a circuit breaker opens. While it is open, the increments are kept in memory, and the other calls fail
+// immediately with ErrUnavailable. After cooldown, the next call replays the increments kept in memory:
+// if it succeeds the breaker closes, otherwise it opens again for cooldown.
+//
+// The increments kept in memory are replayed in their minute if the backend is a database
+// (OpenDB, Buffered, OpenPostgres or OpenRedis),
+// in the minute of the replay otherwise. The backend must return an error only if it didn't count the increment,
+// otherwise it is counted twice.
+//
+// It takes ownership of backend if it is an io.Closer, and must be closed when it is no longer needed.
+func Resilient(backend ContextService, timeout time.Duration, failures int, cooldown time.Duration) *resilient {
+	if failures < 1 {
+		failures = 1
+	}
+	return &resilient{
+		backend:  backend,
+		timeout:  timeout,
+		failures: failures,
+		cooldown: cooldown,
+		pending:  map[hit]int{},
+	}
+}
+
+func (s *resilient) State() BreakerState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.state
+}
+
+// call calls f with the timeout if the breaker allows it, and counts its failure.
+func (s *resilient) call(ctx context.Context, f func(ctx context.Context) error) error {
+	if err := s.allow(ctx); err != nil {
+		return err
+	}
+	callCtx, cancel := context.WithTimeout(ctx, s.timeout)
+	err := f(callCtx)
+	cancel()
+	if ctx.Err() != nil {
+		return err // canceled by the caller, the backend isn't at fault
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err == nil {
+		s.failed = 0
+	} else if s.state == BreakerClosed {
+		if s.failed++; s.failed >= s.failures {
+			s.state = BreakerOpen
+			s.openedAt = time.Now()
+		}
+	}
+	return err
+}
+
+// allow returns nil if the breaker is closed, or if it has been open for the cooldown and the replay succeeds.
+func (s *resilient) allow(ctx context.Context) error {
+	s.mu.Lock()
+	if s.state == BreakerClosed {
+		s.mu.Unlock()
+		return nil
+	}
+	if s.state == BreakerHalfOpen || time.Since(s.openedAt) < s.cooldown {
+		s.mu.Unlock()
+		return ErrUnavailable
+	}
+	s.state = BreakerHalfOpen
+	s.mu.Unlock()
+
+	reached := false // reached is true once the backend has been reached successfully
+	if p, ok := s.backend.(prober); ok {
+		probeCtx, cancel := context.WithTimeout(ctx, s.timeout)
+		err := p.probe(probeCtx)
+		cancel()
+		if err != nil {
+			s.mu.Lock()
+			s.state = BreakerOpen
+			s.openedAt = time.Now()
+			s.mu.Unlock()
+			return ErrUnavailable
+		}
+		reached = true
+	}
+	for {
+		s.mu.Lock()
+		hits := s.pending
+		s.pending = map[hit]int{}
+		if len(hits) == 0 {
+			// Nothing was incremented during the replay
+			s.state = BreakerClosed
+			s.failed = 0
+			if !reached {
+				// Nothing proved that the backend recovered: the next failure opens the breaker again
+				s.failed = s.failures - 1
+			}
+			s.mu.Unlock()
+			return nil
+		}
+		s.mu.Unlock()
+
+		if err := s.replay(ctx, hits); err != nil {
+			s.mu.Lock()
+			for h, count := range hits {
+				s.pending[h] += count
+			}
+			s.state = BreakerOpen
+			s.openedAt = time.Now()
+			s.mu.Unlock()
+			return ErrUnavailable
+		}
+		reached = true
+	}
+}
+
+// replay adds the hits to the backend, within the timeout.
+func (s *resilient) replay(ctx context.Context, hits map[hit]int) error {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	if a, ok := s.backend.(adder); ok {
+		return a.add(ctx, hits)
+	}
+	for h, count := range hits {
+		for ; count > 0; count-- {
+			if err := s.backend.IncrementContext(ctx, h.cfg); err != nil {
+				hits[h] = count // the hits already replayed aren't kept
+				return err
+			}
+		}
+		delete(hits, h)
+	}
+	return nil
+}
+
+func (s *resilient) Increment(cfg fizzbuzz.Config) error {
+	return s.IncrementContext(context.Background(), cfg)
+}
+
+// IncrementContext counts cfg in the backend, or in memory if the breaker is open or opens because of this call.
+func (s *resilient) IncrementContext(ctx context.Context, cfg fizzbuzz.Config) error {
+	h := hit{currentMinute(), cfg}
+	err := s.call(ctx, func(ctx context.Context) error {
+		return s.backend.IncrementContext(ctx, cfg)
+	})
+	if err != nil && ctx.Err() == nil {
+		// The backend didn't count cfg: it is kept in memory if the breaker isn't closed
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.state != BreakerClosed {
+			s.pending[h]++
+			return nil
+		}
+	}
+	return err
+}
+
+func (s *resilient) MostFrequent() (count int, cfg fizzbuzz.Config, err error) {
+	return s.MostFrequentContext(context.Background())
+}
+
+func (s *resilient) MostFrequentContext(ctx context.Context) (count int, cfg fizzbuzz.Config, err error) {
+	err = s.call(ctx, func(ctx context.Context) (err error) {
+		count, cfg, err = s.backend.MostFrequentContext(ctx)
+		return
+	})
+	return
+}
+
+func (s *resilient) MostFrequentIn(w Window) (count int, cfg fizzbuzz.Config, err error) {
+	return s.MostFrequentInContext(context.Background(), w)
+}
+
+func (s *resilient) MostFrequentInContext(ctx context.Context, w Window) (count int, cfg fizzbuzz.Config, err error) {
+	err = s.call(ctx, func(ctx context.Context) (err error) {
+		count, cfg, err = s.backend.MostFrequentInContext(ctx, w)
+		return
+	})
+	return
+}
+
+func (s *resilient) TopN(n int, f Filter) ([]Entry, error) {
+	return s.TopNContext(context.Background(), n, f)
+}
+
+func (s *resilient) TopNContext(ctx context.Context, n int, f Filter) (entries []Entry, err error) {
+	err = s.call(ctx, func(ctx context.Context) (err error) {
+		entries, err = s.backend.TopNContext(ctx, n, f)
+		return
+	})
+	return
+}
+
+func (s *resilient) Compact(now time.Time, r Retention) error {
+	return s.CompactContext(context.Background(), now, r)
+}
+
+func (s *resilient) CompactContext(ctx context.Context, now time.Time, r Retention) error {
+	return s.call(ctx, func(ctx context.Context) error {
+		return s.backend.CompactContext(ctx, now, r)
+	})
+}
+
+// Close replays the increments kept in memory, whatever the state of the breaker, and closes the backend.
+func (s *resilient) Close() error {
+	s.closeOnce.Do(func() {
+		s.mu.Lock()
+		hits := s.pending
+		s.pending = map[hit]int{}
+		s.mu.Unlock()
+
+		if len(hits) > 0 {
+			s.closeErr = s.replay(context.Background(), hits)
+		}
+		if c, ok := s.backend.(io.Closer); ok {
+			s.closeErr = errors.Join(s.closeErr, c.Close())
+		}
+	})
+	return s.closeErr
+}
@@ -0,0 +1,316 @@
+package stats
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// respError is an error reply of a Redis server.
+type respError string
+
+func (e respError) Error() string { return "redis: " + string(e) }
+
+// respConn is a connection to a Redis server, speaking RESP2.
+type respConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	w    *bufio.Writer
+}
+
+// respMaxConns is the maximum number of connections of a client, the calls waiting for a connection beyond.
+const respMaxConns = 16
+
+// respClient is a pool of connections to a Redis server.
+type respClient struct {
+	addr     string
+	username string
+	password string
+	database string
+
+	slots  chan struct{}      // slots holds a value per connection in use, or being dialed
+	idle   chan *respConn     // idle holds the connections not in use, it can hold all of them
+	conns  map[*respConn]bool // conns holds all the connections, to close the ones in use on Close
+	closed bool
+	mu     sync.Mutex // mu protects conns and closed
+}
+
+// newRESPClient returns a client of the server at rawURL: redis://[[user]:password@]host[:port][/database].
+func newRESPClient(rawURL string) (*respClient, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "redis" {
+		return nil, fmt.Errorf("invalid Redis URL scheme %q: must be redis", u.Scheme)
+	}
+	c := &respClient{
+		addr:     u.Host,
+		database: strings.TrimPrefix(u.Path, "/"),
+		slots:    make(chan struct{}, respMaxConns),
+		idle:     make(chan *respConn, respMaxConns),
+		conns:    map[*respConn]bool{},
+	}
+	if u.Port() == "" {
+		c.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if c.database != "" {
+		if _, err := strconv.Atoi(c.database); err != nil {
+			return nil, fmt.Errorf("invalid Redis database %q: must be a number", c.database)
+		}
+	}
+	if u.User != nil {
+		c.username = u.User.Username()
+		c.password, _ = u.User.Password()
+	}
+	return c, nil
+}
+
+// dial opens a connection, authenticated and bound to the database of the client.
+func (c *respClient) dial(ctx context.Context) (*respConn, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", c.addr)
+	if err != nil {
+		return nil, err
+	}
+	rc := &respConn{conn, bufio.NewReader(conn), bufio.NewWriter(conn)}
+	var cmds [][]string
+	if c.password != "" {
+		if c.username != "" {
+			cmds = append(cmds, []string{"AUTH", c.username, c.password})
+		} else {
+			cmds = append(cmds, []string{"AUTH", c.password})
+		}
+	}
+	if c.database != "" {
+		cmds = append(cmds, []string{"SELECT", c.database})
+	}
+	if _, err := rc.do(ctx, cmds); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return rc, nil
+}
+
+// get returns an idle connection, or a new one, waiting while respMaxConns connections are in use.
+func (c *respClient) get(ctx context.Context) (*respConn, error) {
+	select {
+	case c.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	c.mu.Lock()
+	closed := c.closed
+	c.mu.Unlock()
+	if closed {
+		<-c.slots
+		return nil, net.ErrClosed
+	}
+	select {
+	case rc := <-c.idle:
+		return rc, nil
+	default:
+	}
+	rc, err := c.dial(ctx)
+	if err != nil {
+		<-c.slots
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		rc.conn.Close()
+		<-c.slots
+		return nil, net.ErrClosed
+	}
+	c.conns[rc] = true
+	return rc, nil
+}
+
+// put makes the connection idle.
+func (c *respClient) put(rc *respConn) {
+	c.idle <- rc // never blocks, idle can hold all the connections
+	<-c.slots
+}
+
+// discard closes the connection, its state being unknown.
+func (c *respClient) discard(rc *respConn) {
+	rc.conn.Close()
+	c.mu.Lock()
+	delete(c.conns, rc)
+	c.mu.Unlock()
+	<-c.slots
+}
+
+// do sends the commands in one pipeline and returns their replies. An error reply fails the whole call,
+// including an error reply of a command of a transaction (inside the reply of EXEC).
+func (c *respClient) do(ctx context.Context, cmds ...[]string) ([]any, error) {
+	rc, err := c.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	replies, err := rc.do(ctx, cmds)
+	var re respError
+	if err != nil && !errors.As(err, &re) {
+		c.discard(rc)
+		return nil, err
+	}
+	c.put(rc)
+	return replies, err
+}
+
+// with calls f with a connection of its own, for the commands depending on the state of the connection (WATCH).
+// The connection is closed if f fails, its state being unknown.
+func (c *respClient) with(ctx context.Context, f func(do func(cmds ...[]string) ([]any, error)) error) error {
+	rc, err := c.get(ctx)
+	if err != nil {
+		return err
+	}
+	err = f(func(cmds ...[]string) ([]any, error) { return rc.do(ctx, cmds) })
+	if err != nil {
+		c.discard(rc)
+		return err
+	}
+	c.put(rc)
+	return nil
+}
+
+// Close closes all the connections, the calls using one failing.
+func (c *respClient) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	for rc := range c.conns {
+		rc.conn.Close()
+	}
+	return nil
+}
+
+func (rc *respConn) do(ctx context.Context, cmds [][]string) ([]any, error) {
+	if len(cmds) == 0 {
+		return nil, nil
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	// Interrupt the pending reads and writes as soon as ctx is done
+	deadline, _ := ctx.Deadline()
+	rc.conn.SetDeadline(deadline)
+	stop := make(chan struct{})
+	watched := make(chan struct{})
+	go func() {
+		defer close(watched)
+		select {
+		case <-ctx.Done():
+			rc.conn.SetDeadline(time.Now())
+		case <-stop:
+		}
+	}()
+	defer func() {
+		close(stop)
+		<-watched
+	}()
+
+	for _, args := range cmds {
+		fmt.Fprintf(rc.w, "*%d\r\n", len(args))
+		for _, arg := range args {
+			fmt.Fprintf(rc.w, "$%d\r\n%s\r\n", len(arg), arg)
+		}
+	}
+	if err := rc.w.Flush(); err != nil {
+		return nil, contextErr(ctx, err)
+	}
+	replies := make([]any, len(cmds))
+	var replyErr error
+	for i := range replies {
+		reply, err := rc.read()
+		if err != nil {
+			return nil, contextErr(ctx, err)
+		}
+		if err := errorOf(reply); err != nil && replyErr == nil {
+			replyErr = err
+		}
+		replies[i] = reply
+	}
+	return replies, replyErr
+}
+
+// contextErr returns the error of ctx if it is done, as it caused err.
+func contextErr(ctx context.Context, err error) error {
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+	return err
+}
+
+// errorOf returns the first error of a reply, which is an error or an array containing one.
+func errorOf(reply any) error {
+	switch r := reply.(type) {
+	case respError:
+		return r
+	case []any:
+		for _, elem := range r {
+			if err := errorOf(elem); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// read reads a reply: a string (simple or bulk), a respError, an int64, an []any, or nil.
+func (rc *respConn) read() (any, error) {
+	line, err := rc.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || !strings.HasSuffix(line, "\r\n") {
+		return nil, fmt.Errorf("redis: invalid reply line %q", line)
+	}
+	kind, line := line[0], line[1:len(line)-2]
+	switch kind {
+	case '+':
+		return line, nil
+	case '-':
+		return respError(line), nil
+	case ':':
+		return strconv.ParseInt(line, 10, 64)
+	case '$':
+		size, err := strconv.Atoi(line)
+		if err != nil || size < -1 {
+			return nil, fmt.Errorf("redis: invalid bulk size %q", line)
+		}
+		if size == -1 {
+			return nil, nil
+		}
+		b := make([]byte, size+2)
+		if _, err := io.ReadFull(rc.r, b); err != nil {
+			return nil, err
+		}
+		return string(b[:size]), nil
+	case '*':
+		n, err := strconv.Atoi(line)
+		if err != nil || n < -1 {
+			return nil, fmt.Errorf("redis: invalid array size %q", line)
+		}
+		if n == -1 {
+			return nil, nil
+		}
+		elems := make([]any, n)
+		for i := range elems {
+			if elems[i], err = rc.read(); err != nil {
+				return nil, err
+			}
+		}
+		return elems, nil
+	}
+	return nil, fmt.Errorf("redis: invalid reply type %q", kind)
+}
@@ -0,0 +1,153 @@
+package stats
+
+import (
+	"encoding/binary"
+	"hash/maphash"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/xpetit/fizzbuzz/v5"
+)
+
+// shard is a part of the hit count, with its own lock and most frequent config.
+type shard struct {
+	hitCounts
+	mu sync.Mutex // mu protects hitCounts
+
+	_ [64]byte // avoid false sharing between the locks of neighboring shards
+}
+
+type sharded struct {
+	seed   maphash.Seed
+	shards []shard
+}
+
+// Sharded holds a protected (thread safe) hit count, split into n shards with their own lock so that concurrent
+// increments of different configs rarely contend. MostFrequent is O(n), it reads the shards one after the other
+// so the increments made concurrently may or may not be taken into account.
+func Sharded(n int) *sharded {
+	if n < 1 {
+		n = 1
+	}
+	s := &sharded{
+		seed:   maphash.MakeSeed(),
+		shards: make([]shard, n),
+	}
+	for i := range s.shards {
+		s.shards[i].hitCounts = newHitCounts()
+	}
+	return s
+}
+
+// shard returns the shard holding the count of cfg.
+func (s *sharded) shard(cfg fizzbuzz.Config) *shard {
+	var h maphash.Hash
+	h.SetSeed(s.seed)
+	var b [8 * 3]byte
+	binary.LittleEndian.PutUint64(b[0:], uint64(cfg.Limit))
+	binary.LittleEndian.PutUint64(b[8:], uint64(cfg.Int1))
+	binary.LittleEndian.PutUint64(b[16:], uint64(cfg.Int2))
+	h.Write(b[:])
+	h.WriteString(cfg.Str1)
+	h.WriteByte(0) // so that the strings can't be shifted from one to the other
+	h.WriteString(cfg.Str2)
+	return &s.shards[h.Sum64()%uint64(len(s.shards))]
+}
+
+func (s *sharded) Increment(cfg fizzbuzz.Config) error {
+	h := hit{currentMinute(), cfg}
+	sh := s.shard(cfg)
+	sh.mu.Lock()
+	sh.hit(h)
+	sh.mu.Unlock()
+	return nil
+}
+
+func (s *sharded) MostFrequent() (count int, cfg fizzbuzz.Config, err error) {
+	for i := range s.shards {
+		sh := &s.shards[i]
+		sh.mu.Lock()
+		if sh.count > count || sh.count == count && count > 0 && smaller(sh.cfg, cfg) {
+			count = sh.count
+			cfg = sh.cfg
+		}
+		sh.mu.Unlock()
+	}
+	return
+}
+
+func (s *sharded) MostFrequentIn(w Window) (count int, cfg fizzbuzz.Config, err error) {
+	// A config is counted in only one shard, so the most frequent one is the most frequent of a shard
+	for i := range s.shards {
+		sh := &s.shards[i]
+		counts := map[fizzbuzz.Config]int{}
+		sh.mu.Lock()
+		sh.addCounts(counts, w)
+		sh.mu.Unlock()
+		if c, config := mostFrequentOf(counts); c > count || c == count && c > 0 && smaller(config, cfg) {
+			count = c
+			cfg = config
+		}
+	}
+	return
+}
+
+func (s *sharded) Compact(now time.Time, r Retention) error {
+	for i := range s.shards {
+		sh := &s.shards[i]
+		sh.mu.Lock()
+		sh.compact(now, r)
+		sh.mu.Unlock()
+	}
+	return nil
+}
+
+func (s *sharded) TopN(n int, f Filter) ([]Entry, error) {
+	var entries []Entry
+	for i := range s.shards {
+		sh := &s.shards[i]
+		sh.mu.Lock()
+		entries = sh.appendMatches(entries, f)
+		sh.mu.Unlock()
+	}
+	return sortTop(entries, n), nil
+}
+
+func (s *sharded) Snapshot(w io.Writer) error {
+	sn := snapshot{map[fizzbuzz.Config]int{}, buckets{}}
+	for i := range s.shards {
+		sh := &s.shards[i]
+		sh.mu.Lock()
+		sh.addTo(&sn)
+		sh.mu.Unlock()
+	}
+	_, err := w.Write(sn.encode())
+	return err
+}
+
+func (s *sharded) Restore(r io.Reader) error {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	sn, err := decodeSnapshot(b)
+	if err != nil {
+		return err
+	}
+	for cfg, count := range sn.counts {
+		sh := s.shard(cfg)
+		sh.mu.Lock()
+		sh.add(cfg, count)
+		sh.mu.Unlock()
+	}
+	for key, hits := range sn.buckets {
+		for cfg, count := range hits {
+			sh := s.shard(cfg)
+			sh.mu.Lock()
+			sh.buckets.add(key, cfg, count)
+			sh.mu.Unlock()
+		}
+	}
+	return nil
+}
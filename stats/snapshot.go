@@ -0,0 +1,216 @@
+package stats
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/xpetit/fizzbuzz/v5"
+)
+
+// Snapshotter is implemented by the in-memory services, whose hit counts can be saved and restored.
+type Snapshotter interface {
+	// Snapshot writes the hit counts to w.
+	Snapshot(w io.Writer) error
+	// Restore adds the hit counts read from r, written by Snapshot.
+	Restore(r io.Reader) error
+}
+
+// ErrCorruptSnapshot is returned when restoring a snapshot that wasn't written by Snapshot or that has been altered.
+var ErrCorruptSnapshot = errors.New("corrupt snapshot")
+
+// snapshotMagic starts the snapshots, identifying their format version.
+const snapshotMagic = "FBS1"
+
+// snapshot is the content of a snapshot: the lifetime hit counts and the buckets of the time windows.
+//
+// It is encoded as the magic string, the number of configs and each config with its count,
+// the number of buckets and each bucket with its hit counts (referring to the configs by index),
+// then the CRC-32 (IEEE) of all the preceding bytes. The integers are varints and the strings are prefixed by their size.
+type snapshot struct {
+	counts  map[fizzbuzz.Config]int
+	buckets buckets
+}
+
+func (sn *snapshot) encode() []byte {
+	buf := []byte(snapshotMagic)
+	index := make(map[fizzbuzz.Config]uint64, len(sn.counts))
+	buf = binary.AppendUvarint(buf, uint64(len(sn.counts)))
+	for cfg, count := range sn.counts {
+		index[cfg] = uint64(len(index))
+		buf = appendConfig(buf, cfg)
+		buf = binary.AppendUvarint(buf, uint64(count))
+	}
+	buf = binary.AppendUvarint(buf, uint64(len(sn.buckets)))
+	for key, hits := range sn.buckets {
+		buf = binary.AppendVarint(buf, key.start)
+		buf = binary.AppendVarint(buf, key.size)
+		buf = binary.AppendUvarint(buf, uint64(len(hits)))
+		for cfg, count := range hits {
+			buf = binary.AppendUvarint(buf, index[cfg])
+			buf = binary.AppendUvarint(buf, uint64(count))
+		}
+	}
+	return binary.LittleEndian.AppendUint32(buf, crc32.ChecksumIEEE(buf))
+}
+
+// appendConfig appends the encoding of cfg: its integers as varints, then its strings prefixed by their size.
+func appendConfig(buf []byte, cfg fizzbuzz.Config) []byte {
+	buf = binary.AppendVarint(buf, int64(cfg.Limit))
+	buf = binary.AppendVarint(buf, int64(cfg.Int1))
+	buf = binary.AppendVarint(buf, int64(cfg.Int2))
+	buf = binary.AppendUvarint(buf, uint64(len(cfg.Str1)))
+	buf = append(buf, cfg.Str1...)
+	buf = binary.AppendUvarint(buf, uint64(len(cfg.Str2)))
+	return append(buf, cfg.Str2...)
+}
+
+// snapshotDecoder reads the values of a snapshot, keeping the first error.
+type snapshotDecoder struct {
+	r   *bytes.Reader
+	err error
+}
+
+func (d *snapshotDecoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	var i uint64
+	i, d.err = binary.ReadUvarint(d.r)
+	return i
+}
+
+func (d *snapshotDecoder) varint() int64 {
+	if d.err != nil {
+		return 0
+	}
+	var i int64
+	i, d.err = binary.ReadVarint(d.r)
+	return i
+}
+
+// int reads a varint that must fit in an int.
+func (d *snapshotDecoder) int() int {
+	i := d.varint()
+	if int64(int(i)) != i && d.err == nil {
+		d.err = ErrCorruptSnapshot
+	}
+	return int(i)
+}
+
+// count reads a uvarint that must fit in an int, and be at most max.
+func (d *snapshotDecoder) count(max int) int {
+	i := d.uvarint()
+	if i > uint64(max) && d.err == nil {
+		d.err = ErrCorruptSnapshot
+	}
+	return int(i)
+}
+
+func (d *snapshotDecoder) string() string {
+	b := make([]byte, d.count(d.r.Len()))
+	if d.err == nil {
+		_, d.err = io.ReadFull(d.r, b)
+	}
+	return string(b)
+}
+
+// config reads a config encoded by appendConfig.
+func (d *snapshotDecoder) config() (cfg fizzbuzz.Config) {
+	cfg.Limit = d.int()
+	cfg.Int1 = d.int()
+	cfg.Int2 = d.int()
+	cfg.Str1 = d.string()
+	cfg.Str2 = d.string()
+	return
+}
+
+func decodeSnapshot(b []byte) (snapshot, error) {
+	sn := snapshot{map[fizzbuzz.Config]int{}, buckets{}}
+	if len(b) < len(snapshotMagic)+4 || string(b[:len(snapshotMagic)]) != snapshotMagic {
+		return sn, ErrCorruptSnapshot
+	}
+	b, sum := b[:len(b)-4], binary.LittleEndian.Uint32(b[len(b)-4:])
+	if crc32.ChecksumIEEE(b) != sum {
+		return sn, ErrCorruptSnapshot
+	}
+
+	d := snapshotDecoder{r: bytes.NewReader(b[len(snapshotMagic):])}
+	const maxInt = int(^uint(0) >> 1)
+	// Each value takes at least a byte, which bounds the numbers of values
+	configs := make([]fizzbuzz.Config, d.count(d.r.Len()))
+	for i := range configs {
+		configs[i] = d.config()
+		sn.counts[configs[i]] += d.count(maxInt)
+	}
+	for n := d.count(d.r.Len()); n > 0 && d.err == nil; n-- {
+		key := bucket{d.varint(), d.varint()}
+		for n := d.count(d.r.Len()); n > 0 && d.err == nil; n-- {
+			i := d.uvarint()
+			count := d.count(maxInt)
+			if i >= uint64(len(configs)) && d.err == nil {
+				d.err = ErrCorruptSnapshot
+			}
+			if d.err == nil {
+				sn.buckets.add(key, configs[i], count)
+			}
+		}
+	}
+	if d.err == nil && d.r.Len() > 0 {
+		d.err = ErrCorruptSnapshot
+	}
+	if d.err != nil {
+		if !errors.Is(d.err, ErrCorruptSnapshot) {
+			d.err = fmt.Errorf("%w: %v", ErrCorruptSnapshot, d.err)
+		}
+		return sn, d.err
+	}
+	return sn, nil
+}
+
+// SaveSnapshot writes the snapshot of s to the file at path atomically: the snapshot is written to a temporary file
+// in the same directory, which then replaces the file, so the file always holds a complete snapshot.
+func SaveSnapshot(s Snapshotter, path string) error {
+	return writeAtomic(path, s.Snapshot)
+}
+
+// writeAtomic writes a file with write, to a temporary file in the same directory which then replaces the file at path.
+func writeAtomic(path string, write func(w io.Writer) error) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name()) // does nothing once renamed
+
+	if err := write(f); err != nil {
+		f.Close()
+		return err
+	}
+	// Make sure the content is on disk before the rename makes it visible
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// LoadSnapshot restores in s the snapshot of the file at path, if it exists.
+func LoadSnapshot(s Snapshotter, path string) error {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return s.Restore(f)
+}
@@ -1,13 +1,63 @@
 package stats
 
-import "github.com/xpetit/fizzbuzz/v5"
+import (
+	"context"
+	"time"
+
+	"github.com/xpetit/fizzbuzz/v5"
+)
 
 type Service interface {
 	Increment(cfg fizzbuzz.Config) error
 	MostFrequent() (count int, cfg fizzbuzz.Config, err error)
+	// MostFrequentIn is like MostFrequent, but only counts the hits in the window.
+	MostFrequentIn(w Window) (count int, cfg fizzbuzz.Config, err error)
+	// TopN returns the n most frequent configs selected by f, by decreasing count and then in the order of MostFrequent.
+	TopN(n int, f Filter) ([]Entry, error)
+	// Compact merges the old buckets of hits and drops the oldest ones, according to the retention at time now.
+	Compact(now time.Time, r Retention) error
+}
+
+// ContextService is like Service, each call being bound to a context: it fails as soon as the context is done.
+// The persistent services implement it, WithContext adapts the other ones.
+type ContextService interface {
+	IncrementContext(ctx context.Context, cfg fizzbuzz.Config) error
+	MostFrequentContext(ctx context.Context) (count int, cfg fizzbuzz.Config, err error)
+	MostFrequentInContext(ctx context.Context, w Window) (count int, cfg fizzbuzz.Config, err error)
+	TopNContext(ctx context.Context, n int, f Filter) ([]Entry, error)
+	CompactContext(ctx context.Context, now time.Time, r Retention) error
+}
+
+// Approximate is implemented by the services whose counts may be overestimated.
+type Approximate interface {
+	// MaxError returns the maximum overestimation of the lifetime counts.
+	MaxError() int
 }
 
 var (
 	_ Service = (*memory)(nil)
+	_ Service = (*sharded)(nil)
+	_ Service = (*approx)(nil)
 	_ Service = (*db)(nil)
+	_ Service = (*buffered)(nil)
+	_ Service = (*journal)(nil)
+	_ Service = (*resilient)(nil)
+	_ Service = (*replicated)(nil)
+	_ Service = (*redis)(nil)
+	_ Service = (*postgres)(nil)
+
+	_ ContextService = (*db)(nil)
+	_ ContextService = (*buffered)(nil)
+	_ ContextService = (*resilient)(nil)
+	_ ContextService = (*redis)(nil)
+	_ ContextService = (*postgres)(nil)
+
+	_ Breaker = (*resilient)(nil)
+
+	_ Approximate = (*approx)(nil)
+
+	_ Snapshotter = (*memory)(nil)
+	_ Snapshotter = (*sharded)(nil)
+
+	_ Mergeable = (*replicated)(nil)
 )
@@ -1,12 +1,26 @@
 package stats_test
 
 import (
+	"bytes"
 	"context"
+	"database/sql"
+	"errors"
+	"fmt"
 	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/xpetit/fizzbuzz/v5"
 	"github.com/xpetit/fizzbuzz/v5/stats"
+	"github.com/xpetit/fizzbuzz/v5/stats/pgtest"
+	"github.com/xpetit/fizzbuzz/v5/stats/redistest"
+	"github.com/xpetit/fizzbuzz/v5/stats/statstest"
 )
 
 func Benchmark(b *testing.B) {
@@ -34,6 +48,15 @@ func Benchmark(b *testing.B) {
 		}
 	})
 
+	approx := stats.Approx(10_000)
+	b.Run("Approx", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if err := approx.Increment(randomFB[rand.Intn(len(randomFB))]); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
 	db, err := stats.OpenDB(context.Background(), ":memory:")
 	if err != nil {
 		b.Fatal("failed to open database:", err)
@@ -48,4 +71,1258 @@ func Benchmark(b *testing.B) {
 	if err := db.Close(); err != nil {
 		b.Fatal("failed to close database:", err)
 	}
+
+	db, err = stats.OpenDB(context.Background(), ":memory:")
+	if err != nil {
+		b.Fatal("failed to open database:", err)
+	}
+	buffered := stats.Buffered(db, time.Second, 10_000)
+	b.Run("Buffered", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if err := buffered.Increment(randomFB[rand.Intn(len(randomFB))]); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	if err := buffered.Close(); err != nil {
+		b.Fatal("failed to close database:", err)
+	}
+
+	journal, err := stats.OpenJournal(b.TempDir())
+	if err != nil {
+		b.Fatal("failed to open journal:", err)
+	}
+	b.Run("Journal", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if err := journal.Increment(randomFB[rand.Intn(len(randomFB))]); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	if err := journal.Close(); err != nil {
+		b.Fatal("failed to close journal:", err)
+	}
+}
+
+// BenchmarkParallel measures how the increments scale with the number of goroutines (see the -cpu flag)
+func BenchmarkParallel(b *testing.B) {
+	randomFB := make([]fizzbuzz.Config, 100_000)
+	for i := range randomFB {
+		randomFB[i] = fizzbuzz.Config{
+			Int1:  rand.Intn(10_000),
+			Int2:  rand.Intn(10_000),
+			Limit: rand.Intn(10_000),
+		}
+	}
+
+	for name, mem := range map[string]stats.Service{
+		"Memory":  stats.Memory(),
+		"Sharded": stats.Sharded(64),
+	} {
+		b.Run(name, func(b *testing.B) {
+			b.RunParallel(func(pb *testing.PB) {
+				r := rand.New(rand.NewSource(rand.Int63()))
+				for pb.Next() {
+					if err := mem.Increment(randomFB[r.Intn(len(randomFB))]); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		})
+	}
+}
+
+// BenchmarkMostFrequent shows that MostFrequent doesn't depend on the number of distinct configs
+func BenchmarkMostFrequent(b *testing.B) {
+	for _, n := range []int{1e3, 1e4, 1e5, 1e6} {
+		mem := stats.Memory()
+		for i := 0; i < n; i++ {
+			if err := mem.Increment(fizzbuzz.Config{Limit: i}); err != nil {
+				b.Fatal(err)
+			}
+		}
+		b.Run(fmt.Sprintf("Memory/[configs:%.0e]", float64(n)), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, _, err := mem.MostFrequent(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// TestConformance checks that all the services behave in the same way
+func TestConformance(t *testing.T) {
+	for name, newService := range map[string]func(t *testing.T) stats.Service{
+		"Memory":  func(*testing.T) stats.Service { return stats.Memory() },
+		"Sharded": func(*testing.T) stats.Service { return stats.Sharded(4) },
+		"Approx":  func(*testing.T) stats.Service { return stats.Approx(1000) }, // exact with fewer configs
+		"DB": func(t *testing.T) stats.Service {
+			db, err := stats.OpenDB(context.Background(), ":memory:")
+			if err != nil {
+				t.Fatal("failed to open database:", err)
+			}
+			t.Cleanup(func() { db.Close() })
+			return db
+		},
+		"Buffered": func(t *testing.T) stats.Service {
+			db, err := stats.OpenDB(context.Background(), filepath.Join(t.TempDir(), "data.db"))
+			if err != nil {
+				t.Fatal("failed to open database:", err)
+			}
+			buffered := stats.Buffered(db, time.Millisecond, 3)
+			t.Cleanup(func() { buffered.Close() })
+			return buffered
+		},
+		"Resilient": func(t *testing.T) stats.Service {
+			db, err := stats.OpenDB(context.Background(), ":memory:")
+			if err != nil {
+				t.Fatal("failed to open database:", err)
+			}
+			resilient := stats.Resilient(db, time.Second, 5, time.Second)
+			t.Cleanup(func() { resilient.Close() })
+			return resilient
+		},
+		"Replicated": func(*testing.T) stats.Service { return stats.Replicated("node") },
+		"Journal": func(t *testing.T) stats.Service {
+			journal, err := stats.OpenJournal(t.TempDir())
+			if err != nil {
+				t.Fatal("failed to open journal:", err)
+			}
+			t.Cleanup(func() { journal.Close() })
+			return journal
+		},
+		"Redis": func(t *testing.T) stats.Service {
+			return openRedis(t)
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			statstest.RunConformance(t, newService)
+		})
+	}
+	t.Run("Postgres", func(t *testing.T) {
+		server, err := pgtest.NewServer()
+		if errors.Is(err, pgtest.ErrUnavailable) {
+			t.Skip(err)
+		} else if err != nil {
+			t.Fatal("failed to start PostgreSQL:", err)
+		}
+		defer server.Close()
+		statstest.RunConformance(t, func(t *testing.T) stats.Service {
+			dsn, err := server.NewDatabase()
+			if err != nil {
+				t.Fatal("failed to create database:", err)
+			}
+			db, err := stats.OpenPostgres(context.Background(), dsn)
+			if err != nil {
+				t.Fatal("failed to open database:", err)
+			}
+			t.Cleanup(func() { db.Close() })
+			return db
+		})
+
+		// The clients starting together don't fail to create the same tables
+		dsn, err := server.NewDatabase()
+		if err != nil {
+			t.Fatal("failed to create database:", err)
+		}
+		errs := make(chan error)
+		for i := 0; i < 4; i++ {
+			go func() {
+				db, err := stats.OpenPostgres(context.Background(), dsn)
+				if err == nil {
+					db.Close()
+				}
+				errs <- err
+			}()
+		}
+		for i := 0; i < 4; i++ {
+			if err := <-errs; err != nil {
+				t.Fatal("failed to open database concurrently:", err)
+			}
+		}
+	})
+}
+
+// openRedis returns Redis stats on a stand-in server, closed at the end of the test.
+func openRedis(t *testing.T) interface {
+	stats.Service
+	stats.ContextService
+} {
+	t.Helper()
+	server := redistest.NewServer()
+	t.Cleanup(server.Close)
+	redis, err := stats.OpenRedis(context.Background(), server.URL)
+	if err != nil {
+		t.Fatal("failed to connect to Redis:", err)
+	}
+	t.Cleanup(func() { redis.Close() })
+	return redis
+}
+
+// TestRedisCompact checks that the compaction lock of Redis is only released by the client holding it
+func TestRedisCompact(t *testing.T) {
+	server := redistest.NewServer()
+	defer server.Close()
+	redis, err := stats.OpenRedis(context.Background(), server.URL)
+	if err != nil {
+		t.Fatal("failed to connect to Redis:", err)
+	}
+	defer redis.Close()
+	cfg := fizzbuzz.Config{Limit: 1}
+	if err := redis.Increment(cfg); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(3 * time.Hour)
+	if err := redis.Compact(later, stats.DefaultRetention); err != nil {
+		t.Fatal(err)
+	}
+	if lock, ok := server.Get("fizzbuzz:compact"); ok {
+		t.Fatalf("the lock %q wasn't released", lock)
+	}
+
+	// The compaction is skipped while another client holds the lock, which stays
+	if err := redis.Increment(cfg); err != nil {
+		t.Fatal(err)
+	}
+	server.Set("fizzbuzz:compact", "other")
+	if err := redis.Compact(later, stats.DefaultRetention); err != nil {
+		t.Fatal(err)
+	}
+	if lock, _ := server.Get("fizzbuzz:compact"); lock != "other" {
+		t.Fatalf("got lock %q, want %q", lock, "other")
+	}
+	for _, w := range []stats.Window{{Since: time.Now().Add(-24 * time.Hour)}, {}} {
+		if count, got, err := redis.MostFrequentIn(w); err != nil || count != 2 || got != cfg {
+			t.Fatalf("%+v: got %d %+v %v, want 2 %+v <nil>", w, count, got, err, cfg)
+		}
+	}
+}
+
+// TestRedisConns checks that the connections to Redis are bounded under load, and all closed by Close
+func TestRedisConns(t *testing.T) {
+	server := redistest.NewServer()
+	defer server.Close()
+	redis, err := stats.OpenRedis(context.Background(), server.URL)
+	if err != nil {
+		t.Fatal("failed to connect to Redis:", err)
+	}
+	var wg sync.WaitGroup
+	increment := func(n int) {
+		for i := 0; i < 64; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				for j := 0; j < n; j++ {
+					redis.Increment(fizzbuzz.Config{Limit: i})
+				}
+			}(i)
+		}
+	}
+	increment(10)
+	wg.Wait()
+	if _, accepted := server.Conns(); accepted > 16 {
+		t.Fatalf("%d connections were opened", accepted)
+	}
+
+	// The connections in use are closed too
+	increment(1000)
+	redis.Close()
+	wg.Wait()
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+		open, _ := server.Conns()
+		if open == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d connections are still open", open)
+		}
+	}
+	if err := redis.Increment(fizzbuzz.Config{}); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("got %v, want %v", err, net.ErrClosed)
+	}
+}
+
+// TestContext checks that the calls fail when their context is done, but not when the context of OpenDB is done
+func TestContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	db, err := stats.OpenDB(ctx, ":memory:")
+	if err != nil {
+		t.Fatal("failed to open database:", err)
+	}
+	defer db.Close()
+	cancel()
+	bufferedDB, err := stats.OpenDB(context.Background(), ":memory:")
+	if err != nil {
+		t.Fatal("failed to open database:", err)
+	}
+	buffered := stats.Buffered(bufferedDB, time.Hour, 10)
+	defer buffered.Close()
+
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	cfg := fizzbuzz.Config{Limit: 1}
+	for name, s := range map[string]stats.ContextService{
+		"Memory":   stats.WithContext(stats.Memory()),
+		"Approx":   stats.WithContext(stats.Approx(10)),
+		"DB":       stats.WithContext(db),
+		"Buffered": stats.WithContext(buffered),
+		"Redis":    stats.WithContext(openRedis(t)),
+	} {
+		if err := s.IncrementContext(context.Background(), cfg); err != nil {
+			t.Fatal(name, err)
+		}
+		if count, got, err := s.MostFrequentContext(context.Background()); err != nil {
+			t.Fatal(name, err)
+		} else if count != 1 || got != cfg {
+			t.Fatalf("%s: got %d %+v, want 1 %+v", name, count, got, cfg)
+		}
+
+		for call, err := range map[string]error{
+			"IncrementContext":      s.IncrementContext(canceled, cfg),
+			"CompactContext":        s.CompactContext(canceled, time.Now(), stats.DefaultRetention),
+			"MostFrequentContext":   func() error { _, _, err := s.MostFrequentContext(canceled); return err }(),
+			"MostFrequentInContext": func() error { _, _, err := s.MostFrequentInContext(canceled, stats.Window{}); return err }(),
+			"TopNContext":           func() error { _, err := s.TopNContext(canceled, 1, stats.Filter{}); return err }(),
+		} {
+			if !errors.Is(err, context.Canceled) {
+				t.Fatalf("%s %s: got %v, want %v", name, call, err, context.Canceled)
+			}
+		}
+		if _, ok := s.(stats.Approximate); ok != (name == "Approx") {
+			t.Fatalf("%s: the adapter must only be approximate for an approximate service", name)
+		}
+	}
+}
+
+// flaky is a backend whose calls fail with err, if not nil, or block until their context is done if block is set.
+type flaky struct {
+	stats.ContextService
+	err    atomic.Pointer[error]
+	block  atomic.Bool
+	calls  atomic.Int64
+	closed atomic.Int64
+}
+
+func (s *flaky) Close() error {
+	s.closed.Add(1)
+	return nil
+}
+
+func (s *flaky) fail(ctx context.Context) error {
+	s.calls.Add(1)
+	if s.block.Load() {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	if err := s.err.Load(); err != nil {
+		return *err
+	}
+	return nil
+}
+
+func (s *flaky) IncrementContext(ctx context.Context, cfg fizzbuzz.Config) error {
+	if err := s.fail(ctx); err != nil {
+		return err
+	}
+	return s.ContextService.IncrementContext(ctx, cfg)
+}
+
+func (s *flaky) MostFrequentContext(ctx context.Context) (int, fizzbuzz.Config, error) {
+	if err := s.fail(ctx); err != nil {
+		return 0, fizzbuzz.Config{}, err
+	}
+	return s.ContextService.MostFrequentContext(ctx)
+}
+
+// TestResilient checks the timeouts and the circuit breaker, and that the increments made while it is open are replayed
+func TestResilient(t *testing.T) {
+	const (
+		failures = 3
+		cooldown = 50 * time.Millisecond
+	)
+	backend := &flaky{ContextService: stats.WithContext(stats.Memory())}
+	s := stats.Resilient(backend, 20*time.Millisecond, failures, cooldown)
+	defer s.Close()
+	a := fizzbuzz.Config{Limit: 1}
+	b := fizzbuzz.Config{Limit: 2}
+	assert := func(wantState stats.BreakerState, wantCount int, wantCfg fizzbuzz.Config, wantErr error) {
+		t.Helper()
+		count, cfg, err := s.MostFrequent()
+		if !errors.Is(err, wantErr) {
+			t.Fatalf("got error %v, want %v", err, wantErr)
+		}
+		if err == nil && (count != wantCount || cfg != wantCfg) {
+			t.Fatalf("got %d %+v, want %d %+v", count, cfg, wantCount, wantCfg)
+		}
+		if state := s.State(); state != wantState {
+			t.Fatalf("got state %v, want %v", state, wantState)
+		}
+	}
+
+	check := func(err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	check(s.Increment(a))
+	assert(stats.BreakerClosed, 1, a, nil)
+
+	// The calls time out, the breaker opens after the given number of failures
+	backend.block.Store(true)
+	start := time.Now()
+	for i := 1; i < failures; i++ {
+		if err := s.Increment(b); !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("got %v, want %v", err, context.DeadlineExceeded)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("the calls weren't limited by the timeout: %v", elapsed)
+	}
+	check(s.Increment(b)) // counted in memory
+	assert(stats.BreakerOpen, 0, fizzbuzz.Config{}, stats.ErrUnavailable)
+
+	// While the breaker is open, the backend isn't called
+	calls := backend.calls.Load()
+	for i := 0; i < 3; i++ {
+		check(s.Increment(b))
+	}
+	assert(stats.BreakerOpen, 0, fizzbuzz.Config{}, stats.ErrUnavailable)
+	if n := backend.calls.Load(); n != calls {
+		t.Fatalf("the backend was called %d times while the breaker was open", n-calls)
+	}
+
+	// After the cooldown, the backend is tried again, and fails
+	errFailing := errors.New("failing")
+	backend.block.Store(false)
+	backend.err.Store(&errFailing)
+	time.Sleep(cooldown)
+	check(s.Increment(b))
+	assert(stats.BreakerOpen, 0, fizzbuzz.Config{}, stats.ErrUnavailable)
+
+	// Once the backend recovers, the increments kept in memory are replayed by the next call.
+	// The ones that failed before the breaker opened were returned as errors, so they aren't counted.
+	backend.err.Store(nil)
+	time.Sleep(cooldown)
+	assert(stats.BreakerClosed, 5, b, nil)
+	check(s.Increment(a))
+	assert(stats.BreakerClosed, 5, b, nil)
+
+	// The calls canceled by the caller aren't failures of the backend
+	backend.block.Store(true)
+	for i := 0; i < failures; i++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		if err := s.IncrementContext(ctx, a); !errors.Is(err, context.Canceled) {
+			t.Fatalf("got %v, want %v", err, context.Canceled)
+		}
+	}
+	backend.block.Store(false)
+	assert(stats.BreakerClosed, 5, b, nil)
+
+	// The backend is closed once, whatever the number of calls to Close
+	for i := 0; i < 2; i++ {
+		check(s.Close())
+	}
+	if n := backend.closed.Load(); n != 1 {
+		t.Fatalf("the backend was closed %d times", n)
+	}
+}
+
+// TestResilientBuffered checks that the breaker of a buffered database is driven by the database, not by the buffer
+func TestResilientBuffered(t *testing.T) {
+	const (
+		failures = 2
+		cooldown = 20 * time.Millisecond
+	)
+	db, err := stats.OpenDB(context.Background(), ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	buffered := stats.Buffered(db, time.Millisecond, 10_000)
+	s := stats.Resilient(buffered, time.Second, failures, cooldown)
+	defer s.Close()
+	a := fizzbuzz.Config{Limit: 1}
+	for i := 0; i < 3; i++ {
+		if err := s.Increment(a); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if count, cfg, err := s.MostFrequent(); err != nil || count != 3 || cfg != a {
+		t.Fatalf("got %d %+v %v, want 3 %+v <nil>", count, cfg, err, a)
+	}
+
+	// The increments succeed, kept in the buffer only, so Resilient doesn't count them a second time
+	db.Close()
+	for i := 0; i < 3; i++ {
+		if err := s.Increment(a); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for deadline := time.Now().Add(time.Second); buffered.Err() == nil; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("the failure of the background flush isn't reported")
+		}
+	}
+	for i := 0; i < failures; i++ {
+		if _, _, err := s.MostFrequent(); err == nil || errors.Is(err, stats.ErrUnavailable) {
+			t.Fatalf("got error %v, want the error of the database", err)
+		}
+	}
+	if state := s.State(); state != stats.BreakerOpen {
+		t.Fatalf("got state %v, want %v", state, stats.BreakerOpen)
+	}
+
+	// After the cooldown, the probe reaches the database, which still fails
+	time.Sleep(cooldown)
+	if _, _, err := s.MostFrequent(); !errors.Is(err, stats.ErrUnavailable) {
+		t.Fatalf("got error %v, want %v", err, stats.ErrUnavailable)
+	}
+	if state := s.State(); state != stats.BreakerOpen {
+		t.Fatalf("got state %v, want %v", state, stats.BreakerOpen)
+	}
+}
+
+// TestReplicated checks that the replicas converge to the same counts, whatever the order of the merges
+func TestReplicated(t *testing.T) {
+	ids := []string{"a", "b", "c"}
+	replicas := map[string]interface {
+		stats.Service
+		stats.Mergeable
+		stats.Snapshotter
+	}{}
+	for _, id := range ids {
+		replicas[id] = stats.Replicated(id)
+	}
+	mem := stats.Memory()
+	increment := func(n int) {
+		t.Helper()
+		for i := 0; i < n; i++ {
+			cfg := fizzbuzz.Config{Limit: rand.Intn(10), Str1: "🍕"}
+			if err := replicas[ids[rand.Intn(len(ids))]].Increment(cfg); err != nil {
+				t.Fatal(err)
+			}
+			mem.Increment(cfg)
+		}
+	}
+	// known holds the versions that each replica knows another one has, after their last synchronization
+	known := map[[2]string]map[string]uint64{}
+	sync := func(from, to string) (nodes int) {
+		t.Helper()
+		var b bytes.Buffer
+		if err := replicas[from].Export(&b, known[[2]string{from, to}]); err != nil {
+			t.Fatal(err)
+		}
+		nodes = strings.Count(b.String(), `"state"`)
+		versions, err := replicas[to].Merge(&b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The receiver has at least the versions of the sender
+		known[[2]string{from, to}] = versions
+		return nodes
+	}
+	assert := func(step string) {
+		t.Helper()
+		want, _ := mem.TopN(100, stats.Filter{})
+		wantCount, wantCfg, _ := mem.MostFrequent()
+		wantCountIn, wantCfgIn, _ := mem.MostFrequentIn(stats.Window{Since: time.Now().Add(-time.Hour)})
+		for id, r := range replicas {
+			if got, err := r.TopN(100, stats.Filter{}); err != nil {
+				t.Fatal(id, err)
+			} else if fmt.Sprint(got) != fmt.Sprint(want) {
+				t.Fatalf("%s %s:\ngot:  %v\nwant: %v", id, step, got, want)
+			}
+			if count, cfg, err := r.MostFrequent(); err != nil {
+				t.Fatal(id, err)
+			} else if count != wantCount || cfg != wantCfg {
+				t.Fatalf("%s %s: got %d %+v, want %d %+v", id, step, count, cfg, wantCount, wantCfg)
+			}
+			if count, cfg, err := r.MostFrequentIn(stats.Window{Since: time.Now().Add(-time.Hour)}); err != nil {
+				t.Fatal(id, err)
+			} else if count != wantCountIn || cfg != wantCfgIn {
+				t.Fatalf("%s %s in the last hour: got %d %+v, want %d %+v", id, step, count, cfg, wantCountIn, wantCfgIn)
+			}
+		}
+	}
+
+	increment(300)
+	// Gossip in a ring, twice so that each replica receives the states of all the others
+	for i := 0; i < 2; i++ {
+		sync("a", "b")
+		sync("b", "c")
+		sync("c", "a")
+	}
+	assert("after gossip")
+
+	// Merging the same states again changes nothing
+	for _, from := range ids {
+		for _, to := range ids {
+			if from != to {
+				sync(from, to)
+			}
+		}
+	}
+	assert("after merging twice")
+
+	increment(200)
+	for _, r := range replicas {
+		if err := r.Compact(time.Now().Add(3*time.Hour), stats.DefaultRetention); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Each replica pushes its state to a and pulls the others in the response, in any order
+	for _, from := range []string{"c", "b", "a", "c", "b"} {
+		var b bytes.Buffer
+		if err := replicas[from].Export(&b, nil); err != nil {
+			t.Fatal(err)
+		}
+		versions, err := replicas["a"].Merge(&b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b.Reset()
+		if err := replicas["a"].Export(&b, versions); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := replicas[from].Merge(&b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mem.Compact(time.Now().Add(3*time.Hour), stats.DefaultRetention)
+	assert("after compaction")
+
+	// Only the states more recent than the versions known by the peer are exported
+	sync("a", "b")
+	if nodes := sync("a", "b"); nodes != 0 {
+		t.Fatalf("%d states exported without changes", nodes)
+	}
+	// After one increment, only its count is exported, not the whole state of the node
+	var full, delta bytes.Buffer
+	if err := replicas["a"].Increment(fizzbuzz.Config{Limit: 3, Str1: "🍕"}); err != nil {
+		t.Fatal(err)
+	}
+	mem.Increment(fizzbuzz.Config{Limit: 3, Str1: "🍕"})
+	if err := replicas["a"].Export(&full, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := replicas["a"].Export(&delta, known[[2]string{"a", "b"}]); err != nil {
+		t.Fatal(err)
+	}
+	if delta.Len() > 200 || delta.Len()*4 > full.Len() {
+		t.Fatalf("%d bytes exported after one increment, %d for the whole state", delta.Len(), full.Len())
+	}
+	sync("a", "b")
+	sync("a", "c")
+	if _, err := replicas["a"].Merge(strings.NewReader(`{"nodes":[{"id":"x","version":1,"state":"AAAA"}]}`)); !errors.Is(err, stats.ErrCorruptSnapshot) {
+		t.Fatalf("got %v, want %v", err, stats.ErrCorruptSnapshot)
+	}
+
+	// A replica restarted from its snapshot keeps its ID and its state, so its next increments are merged by the others
+	file := filepath.Join(t.TempDir(), "stats.snapshot")
+	if err := stats.SaveSnapshot(replicas["c"], file); err != nil {
+		t.Fatal(err)
+	}
+	id, err := stats.SnapshotNodeID(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != "c" {
+		t.Fatalf("got node ID %q, want %q", id, "c")
+	}
+	restarted := stats.Replicated(id)
+	if err := stats.LoadSnapshot(restarted, file); err != nil {
+		t.Fatal(err)
+	}
+	replicas["c"] = restarted
+	assert("after restart")
+	for i := 0; i < 10; i++ {
+		cfg := fizzbuzz.Config{Limit: 1, Str1: "🍕"}
+		restarted.Increment(cfg)
+		mem.Increment(cfg)
+	}
+	sync("c", "a")
+	sync("a", "b")
+	assert("after restart and gossip")
+	if id, err := stats.SnapshotNodeID(filepath.Join(t.TempDir(), "missing")); err != nil || id != "" {
+		t.Fatalf("got %q %v for a missing snapshot, want an empty ID", id, err)
+	}
+}
+
+// TestMemory checks that the most frequent config is the one found by scanning all of them
+func TestMemory(t *testing.T) {
+	for name, mem := range map[string]stats.Service{
+		"Memory":  stats.Memory(),
+		"Sharded": stats.Sharded(8),
+		"Approx":  stats.Approx(1000), // exact with fewer configs
+	} {
+		counts := map[fizzbuzz.Config]int{}
+		for i := 0; i < 10_000; i++ {
+			cfg := fizzbuzz.Config{Int1: rand.Intn(50), Int2: rand.Intn(3)}
+			counts[cfg]++
+			if err := mem.Increment(cfg); err != nil {
+				t.Fatal(err)
+			}
+
+			var wantCount int
+			var wantCfg fizzbuzz.Config
+			for c, n := range counts {
+				if n > wantCount || n == wantCount && (c.Int1 < wantCfg.Int1 || c.Int1 == wantCfg.Int1 && c.Int2 < wantCfg.Int2) {
+					wantCount, wantCfg = n, c
+				}
+			}
+			count, cfg, err := mem.MostFrequent()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if count != wantCount || cfg != wantCfg {
+				t.Fatalf("%s after %d increments: got %d %+v, want %d %+v", name, i+1, count, cfg, wantCount, wantCfg)
+			}
+		}
+	}
+}
+
+// TestBuffered checks that the pending counts are combined with the persisted ones, and written on Close
+func TestBuffered(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "data.db")
+	open := func() interface {
+		stats.Service
+		Close() error
+	} {
+		db, err := stats.OpenDB(context.Background(), file)
+		if err != nil {
+			t.Fatal("failed to open database:", err)
+		}
+		return stats.Buffered(db, time.Hour, 2)
+	}
+	assert := func(s stats.Service, wantCount int, wantCfg fizzbuzz.Config) {
+		t.Helper()
+		count, cfg, err := s.MostFrequent()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != wantCount || cfg != wantCfg {
+			t.Fatalf("got %d %+v, want %d %+v", count, cfg, wantCount, wantCfg)
+		}
+	}
+
+	a := fizzbuzz.Config{Limit: 1}
+	b := fizzbuzz.Config{Limit: 2}
+	s := open()
+	assert(s, 0, fizzbuzz.Config{})
+	for _, cfg := range []fizzbuzz.Config{b, b, a, a, a, b} {
+		if err := s.Increment(cfg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	assert(s, 3, a) // tie broken by the smallest config, whatever has been flushed
+	if err := s.Close(); err != nil {
+		t.Fatal("failed to close database:", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal("failed to close database twice:", err)
+	}
+
+	s = open()
+	assert(s, 3, a)
+	if err := s.Increment(b); err != nil {
+		t.Fatal(err)
+	}
+	assert(s, 4, b)
+	if err := s.Close(); err != nil {
+		t.Fatal("failed to close database:", err)
+	}
+}
+
+// TestBufferedMany checks that the persisted counts of more pending configs than a query can read are combined
+func TestBufferedMany(t *testing.T) {
+	db, err := stats.OpenDB(context.Background(), ":memory:")
+	if err != nil {
+		t.Fatal("failed to open database:", err)
+	}
+	buffered := stats.Buffered(db, time.Hour, 10_000)
+	defer buffered.Close()
+	increment := func(s stats.Service, cfg fizzbuzz.Config, n int) {
+		t.Helper()
+		for i := 0; i < n; i++ {
+			if err := s.Increment(cfg); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	for i := 0; i < 2500; i++ {
+		increment(db, fizzbuzz.Config{Limit: i}, 1)
+		increment(buffered, fizzbuzz.Config{Limit: i}, 1)
+	}
+	a, b := fizzbuzz.Config{Limit: 1234}, fizzbuzz.Config{Limit: 2000}
+	increment(db, a, 2)
+	increment(buffered, b, 3)
+
+	for _, w := range []*stats.Window{nil, {}} {
+		var count int
+		var cfg fizzbuzz.Config
+		if w == nil {
+			count, cfg, err = buffered.MostFrequent()
+		} else {
+			count, cfg, err = buffered.MostFrequentIn(*w)
+		}
+		if err != nil {
+			t.Fatal(err)
+		} else if count != 5 || cfg != b {
+			t.Fatalf("%+v: got %d %+v, want 5 %+v", w, count, cfg, b)
+		}
+	}
+	entries, err := buffered.TopN(2, stats.Filter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []stats.Entry{{Count: 5, Config: b}, {Count: 4, Config: a}}; fmt.Sprint(entries) != fmt.Sprint(want) {
+		t.Fatalf("got %+v, want %+v", entries, want)
+	}
+}
+
+// TestJournal checks that the journal is restored from its checkpoint and logs, a torn last record being discarded
+func TestJournal(t *testing.T) {
+	dir := t.TempDir()
+	open := func() interface {
+		stats.Service
+		Close() error
+	} {
+		t.Helper()
+		s, err := stats.OpenJournal(dir)
+		if err != nil {
+			t.Fatal("failed to open journal:", err)
+		}
+		return s
+	}
+	mem := stats.Memory()
+	increment := func(s stats.Service, n int) {
+		t.Helper()
+		for i := 0; i < n; i++ {
+			cfg := fizzbuzz.Config{Limit: rand.Intn(20), Str1: strings.Repeat("🍕", rand.Intn(3))}
+			if err := s.Increment(cfg); err != nil {
+				t.Fatal(err)
+			}
+			mem.Increment(cfg)
+		}
+	}
+	assert := func(s stats.Service, step string) {
+		t.Helper()
+		want, _ := mem.TopN(100, stats.Filter{})
+		if got, err := s.TopN(100, stats.Filter{}); err != nil {
+			t.Fatal(step, err)
+		} else if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Fatalf("%s:\ngot:  %v\nwant: %v", step, got, want)
+		}
+		wantCount, wantCfg, _ := mem.MostFrequentIn(stats.Window{Since: time.Now().Add(-time.Hour)})
+		if count, cfg, err := s.MostFrequentIn(stats.Window{Since: time.Now().Add(-time.Hour)}); err != nil {
+			t.Fatal(step, err)
+		} else if count != wantCount || cfg != wantCfg {
+			t.Fatalf("%s: got %d %+v, want %d %+v", step, count, cfg, wantCount, wantCfg)
+		}
+	}
+	lastLog := func() string {
+		t.Helper()
+		logs, err := filepath.Glob(filepath.Join(dir, "*.log"))
+		if err != nil || len(logs) == 0 {
+			t.Fatal("no log:", err)
+		}
+		return logs[len(logs)-1]
+	}
+
+	s := open()
+	increment(s, 500)
+	if err := s.Close(); err != nil {
+		t.Fatal("failed to close journal:", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal("failed to close journal twice:", err)
+	}
+	if err := s.Increment(fizzbuzz.Config{}); !errors.Is(err, os.ErrClosed) {
+		t.Fatalf("increment after Close: got %v, want %v", err, os.ErrClosed)
+	}
+
+	s = open()
+	assert(s, "restored from the checkpoint")
+	increment(s, 300)
+	if err := s.Compact(time.Now(), stats.DefaultRetention); err != nil {
+		t.Fatal(err)
+	}
+	increment(s, 200)
+	// Crash: the journal isn't closed, and a last record is partially written
+	record, err := os.ReadFile(lastLog())
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(lastLog(), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write(record[:8]); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	s = open()
+	assert(s, "restored from the logs after a crash")
+	increment(s, 100)
+	if err := s.Close(); err != nil {
+		t.Fatal("failed to close journal:", err)
+	}
+	s = open()
+	assert(s, "restored after recovery")
+
+	// An altered record before the end of the log isn't torn, the log is corrupt
+	increment(s, 10)
+	b, err := os.ReadFile(lastLog())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b[3] ^= 1
+	if err := os.WriteFile(lastLog(), b, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "ffffffffffffffff.log"), nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stats.OpenJournal(dir); !errors.Is(err, stats.ErrCorruptJournal) {
+		t.Fatalf("got %v, want %v", err, stats.ErrCorruptJournal)
+	}
+}
+
+// TestWindow checks that the backends give the same most frequent configs in time windows, before and after compaction
+func TestWindow(t *testing.T) {
+	db, err := stats.OpenDB(context.Background(), ":memory:")
+	if err != nil {
+		t.Fatal("failed to open database:", err)
+	}
+	defer db.Close()
+	file := filepath.Join(t.TempDir(), "data.db")
+	bufferedDB, err := stats.OpenDB(context.Background(), file)
+	if err != nil {
+		t.Fatal("failed to open database:", err)
+	}
+	buffered := stats.Buffered(bufferedDB, time.Hour, 2)
+	defer buffered.Close()
+	journal, err := stats.OpenJournal(t.TempDir())
+	if err != nil {
+		t.Fatal("failed to open journal:", err)
+	}
+	defer journal.Close()
+	services := map[string]stats.Service{
+		"Memory":   stats.Memory(),
+		"Sharded":  stats.Sharded(4),
+		"Approx":   stats.Approx(10),
+		"DB":       db,
+		"Buffered": buffered,
+		"Journal":  journal,
+		"Redis":    openRedis(t),
+	}
+
+	a := fizzbuzz.Config{Limit: 1}
+	b := fizzbuzz.Config{Limit: 2}
+	for name, s := range services {
+		for _, cfg := range []fizzbuzz.Config{b, a, b, a, b} {
+			if err := s.Increment(cfg); err != nil {
+				t.Fatal(name, err)
+			}
+		}
+	}
+
+	now := time.Now()
+	assert := func(step string, w stats.Window, wantCount int, wantCfg fizzbuzz.Config) {
+		t.Helper()
+		for name, s := range services {
+			count, cfg, err := s.MostFrequentIn(w)
+			if err != nil {
+				t.Fatal(name, err)
+			}
+			if count != wantCount || cfg != wantCfg {
+				t.Fatalf("%s %s %+v: got %d %+v, want %d %+v", name, step, w, count, cfg, wantCount, wantCfg)
+			}
+			if count, cfg, err = s.MostFrequent(); err != nil {
+				t.Fatal(name, err)
+			} else if count != 3 || cfg != b {
+				t.Fatalf("%s %s: the lifetime stats changed: %d %+v", name, step, count, cfg)
+			}
+		}
+	}
+	for _, step := range []struct {
+		name   string
+		now    time.Time
+		recent bool // whether the hits are still in the window of the last hours
+	}{
+		{"before compaction", now, true},
+		{"after compaction in hours", now.Add(3 * time.Hour), true},
+		{"after compaction in days", now.Add(50 * time.Hour), true},
+		{"after retention", now.Add(100 * 24 * time.Hour), false},
+	} {
+		for name, s := range services {
+			if err := s.Compact(step.now, stats.DefaultRetention); err != nil {
+				t.Fatal(name, err)
+			}
+		}
+		if step.recent {
+			assert(step.name, stats.Window{}, 3, b)
+			assert(step.name, stats.Window{Since: now.Add(-24 * time.Hour)}, 3, b)
+			assert(step.name, stats.Window{Since: now.Add(-24 * time.Hour), Until: now.Add(time.Hour)}, 3, b)
+		} else {
+			assert(step.name, stats.Window{}, 0, fizzbuzz.Config{})
+		}
+		assert(step.name, stats.Window{Until: now.Add(-24 * time.Hour)}, 0, fizzbuzz.Config{})
+		assert(step.name, stats.Window{Since: now.Add(time.Hour)}, 0, fizzbuzz.Config{})
+	}
+}
+
+// TestApprox checks the error bounds of the approximate stats
+func TestApprox(t *testing.T) {
+	const k = 10
+	s := stats.Approx(k)
+	a := fizzbuzz.Config{Limit: -1}
+	b := fizzbuzz.Config{Limit: -2}
+	want := map[fizzbuzz.Config]int{}
+	var hits int
+	increment := func(cfg fizzbuzz.Config) {
+		hits++
+		want[cfg]++
+		if err := s.Increment(cfg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 2000; i++ {
+		increment(fizzbuzz.Config{Limit: i}) // each one once
+		if i%2 == 0 {
+			increment(a)
+		}
+		if i%4 == 0 {
+			increment(b)
+		}
+	}
+
+	maxError := s.MaxError()
+	if maxError > hits/k {
+		t.Fatalf("max error %d is greater than %d hits / %d", maxError, hits, k)
+	}
+	count, cfg, err := s.MostFrequent()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg != a || count < want[a] || count > want[a]+maxError {
+		t.Fatalf("got %d %+v, want %d %+v (max error %d)", count, cfg, want[a], a, maxError)
+	}
+
+	// The configs with more hits than the maximum error are guaranteed to be counted
+	top, err := s.TopN(2, stats.Filter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(top) != 2 || top[0].Config != a || top[1].Config != b {
+		t.Fatalf("got %+v, want %+v then %+v", top, a, b)
+	}
+	for _, e := range top {
+		if e.Error > maxError || e.Count-e.Error > want[e.Config] || e.Count < want[e.Config] {
+			t.Fatalf("%+v: the count of %d hits is out of bounds", e, want[e.Config])
+		}
+	}
+}
+
+// TestSnapshot checks that the in-memory stats are restored from their snapshot, and that altered snapshots are rejected
+func TestSnapshot(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "stats.snapshot")
+	mem := stats.Memory()
+	if err := stats.LoadSnapshot(mem, file); err != nil {
+		t.Fatal("a missing snapshot must be ignored:", err)
+	}
+	for i := 0; i < 1000; i++ {
+		cfg := fizzbuzz.Config{Limit: rand.Intn(100) - 50, Int1: rand.Intn(3), Str1: "👌🏻", Str2: strings.Repeat("a", rand.Intn(3))}
+		if err := mem.Increment(cfg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := mem.Compact(time.Now().Add(3*time.Hour), stats.DefaultRetention); err != nil {
+		t.Fatal(err)
+	}
+	if err := stats.SaveSnapshot(mem, file); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, restored := range map[string]interface {
+		stats.Service
+		stats.Snapshotter
+	}{
+		"Memory":  stats.Memory(),
+		"Sharded": stats.Sharded(4),
+	} {
+		if err := stats.LoadSnapshot(restored, file); err != nil {
+			t.Fatal(name, err)
+		}
+		for _, w := range []stats.Window{{}, {Since: time.Now().Add(-time.Hour)}} {
+			wantCount, wantCfg, _ := mem.MostFrequentIn(w)
+			if count, cfg, err := restored.MostFrequentIn(w); err != nil {
+				t.Fatal(name, err)
+			} else if count != wantCount || cfg != wantCfg {
+				t.Fatalf("%s %+v: got %d %+v, want %d %+v", name, w, count, cfg, wantCount, wantCfg)
+			}
+		}
+		want, _ := mem.TopN(1000, stats.Filter{})
+		if got, err := restored.TopN(1000, stats.Filter{}); err != nil {
+			t.Fatal(name, err)
+		} else if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Fatalf("%s:\ngot:  %v\nwant: %v", name, got, want)
+		}
+	}
+
+	var b bytes.Buffer
+	if err := mem.Snapshot(&b); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < b.Len(); i += 7 {
+		altered := bytes.Clone(b.Bytes())
+		altered[i] ^= 1
+		if err := stats.Memory().Restore(bytes.NewReader(altered)); !errors.Is(err, stats.ErrCorruptSnapshot) {
+			t.Fatalf("byte %d altered: got %v, want %v", i, err, stats.ErrCorruptSnapshot)
+		}
+		if err := stats.Memory().Restore(bytes.NewReader(b.Bytes()[:i])); !errors.Is(err, stats.ErrCorruptSnapshot) {
+			t.Fatalf("truncated to %d bytes: got %v, want %v", i, err, stats.ErrCorruptSnapshot)
+		}
+	}
+}
+
+// TestSchemaVersion checks that reading the schema version doesn't change the database, nor create it
+func TestSchemaVersion(t *testing.T) {
+	ctx := context.Background()
+	fixture, err := os.ReadFile(filepath.Join("testdata", "stats-v0.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	file := filepath.Join(dir, "data?#%.db")
+	if err := os.WriteFile(file, fixture, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if version, err := stats.SchemaVersion(ctx, file); err != nil || version != 0 {
+		t.Fatalf("got schema version %d %v, want 0 <nil>", version, err)
+	}
+	if b, err := os.ReadFile(file); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(b, fixture) {
+		t.Fatal("the database was changed")
+	}
+
+	// A database in rollback journal mode isn't switched to WAL, and a missing database isn't created
+	dir = t.TempDir()
+	file = filepath.Join(dir, "data.db")
+	db, err := sql.Open("sqlite3", file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`create table "t" ("c" integer)`); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	before, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range []string{file, filepath.Join(dir, "missing.db")} {
+		if version, err := stats.SchemaVersion(ctx, file); err != nil || version != 0 {
+			t.Fatalf("got schema version %d %v, want 0 <nil>", version, err)
+		}
+	}
+	if b, err := os.ReadFile(file); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(b, before) {
+		t.Fatal("the database was changed")
+	}
+	if entries, err := os.ReadDir(dir); err != nil {
+		t.Fatal(err)
+	} else if len(entries) != 1 {
+		t.Fatalf("got %d files, want only the database", len(entries))
+	}
+}
+
+// TestMigrations checks that a database created before the migrations is upgraded without losing its hits,
+// and that the migrations can be reverted and applied again
+func TestMigrations(t *testing.T) {
+	ctx := context.Background()
+	fixture, err := os.ReadFile(filepath.Join("testdata", "stats-v0.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(t.TempDir(), "data.db")
+	if err := os.WriteFile(file, fixture, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	last := len(stats.Migrations())
+	for i, m := range stats.Migrations() {
+		if m.Version != i+1 {
+			t.Fatalf("migration %d (%s): got version %d, want %d", i, m.Name, m.Version, i+1)
+		}
+	}
+
+	assertVersion := func(want int) {
+		t.Helper()
+		if version, err := stats.SchemaVersion(ctx, file); err != nil {
+			t.Fatal(err)
+		} else if version != want {
+			t.Fatalf("got schema version %d, want %d", version, want)
+		}
+	}
+	// assertCounts opens the database, which applies all the migrations, and checks its most frequent configs
+	assertCounts := func(step string, wantCount, wantCountIn int) {
+		t.Helper()
+		db, err := stats.OpenDB(ctx, file)
+		if err != nil {
+			t.Fatal(step, err)
+		}
+		defer db.Close()
+		want := fizzbuzz.Config{Limit: 100, Int1: 3, Int2: 5, Str1: "fizz", Str2: "buzz"}
+		if count, cfg, err := db.MostFrequent(); err != nil {
+			t.Fatal(step, err)
+		} else if count != wantCount || count > 0 && cfg != want {
+			t.Fatalf("%s: got %d %+v, want %d %+v", step, count, cfg, wantCount, want)
+		}
+		if count, cfg, err := db.MostFrequentIn(stats.Window{}); err != nil {
+			t.Fatal(step, err)
+		} else if count != wantCountIn || count > 0 && cfg != want {
+			t.Fatalf("%s in window: got %d %+v, want %d %+v", step, count, cfg, wantCountIn, want)
+		}
+		assertVersion(last)
+	}
+
+	assertVersion(0)
+	assertCounts("upgraded fixture", 3, 3)
+
+	// Reverting the buckets keeps the lifetime counts
+	if err := stats.MigrateDB(ctx, file, 1); err != nil {
+		t.Fatal(err)
+	}
+	assertVersion(1)
+	assertCounts("buckets reverted", 3, 0)
+
+	if err := stats.MigrateDB(ctx, file, 0); err != nil {
+		t.Fatal(err)
+	}
+	assertVersion(0)
+	assertCounts("all reverted", 0, 0)
+
+	for _, version := range []int{-1, last + 1} {
+		if err := stats.MigrateDB(ctx, file, version); err == nil {
+			t.Fatalf("version %d: the migration must fail", version)
+		}
+	}
+
+	// A database migrated by a more recent program isn't opened
+	db, err := sql.Open("sqlite3", file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.Exec(`insert into "schema_version" ("version", "applied") values (?, 0);`, last+1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stats.OpenDB(ctx, file); !errors.Is(err, stats.ErrSchemaTooNew) {
+		t.Fatalf("got %v, want %v", err, stats.ErrSchemaTooNew)
+	}
 }
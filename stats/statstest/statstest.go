@@ -0,0 +1,352 @@
+// Package statstest checks that implementations of stats.Service behave like the ones of the stats package.
+package statstest
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/xpetit/fizzbuzz/v5"
+	"github.com/xpetit/fizzbuzz/v5/stats"
+)
+
+// RunConformance runs the conformance tests as subtests of t, each one with a new empty service returned by newService,
+// which can register its cleanup with t.Cleanup.
+//
+// The tests count fewer than 100 distinct configs, so the approximate services must count them exactly.
+// Run them with -race to check the concurrency safety.
+func RunConformance(t *testing.T, newService func(t *testing.T) stats.Service) {
+	for _, test := range []struct {
+		name string
+		run  func(t *testing.T, s stats.Service)
+	}{
+		{"Empty", testEmpty},
+		{"Counts", testCounts},
+		{"TieBreak", testTieBreak},
+		{"Unicode", testUnicode},
+		{"Window", testWindow},
+		{"Concurrency", testConcurrency},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			test.run(t, newService(t))
+		})
+	}
+}
+
+// less is the order of the configs with the same count: by limit, int1, int2, str1 and then str2 (compared bytewise).
+func less(a, b fizzbuzz.Config) bool {
+	if a.Limit != b.Limit {
+		return a.Limit < b.Limit
+	}
+	if a.Int1 != b.Int1 {
+		return a.Int1 < b.Int1
+	}
+	if a.Int2 != b.Int2 {
+		return a.Int2 < b.Int2
+	}
+	if a.Str1 != b.Str1 {
+		return a.Str1 < b.Str1
+	}
+	return a.Str2 < b.Str2
+}
+
+// counter increments the configs of a service, keeping the expected counts.
+type counter struct {
+	s    stats.Service
+	want map[fizzbuzz.Config]int
+}
+
+func newCounter(s stats.Service) *counter {
+	return &counter{s, map[fizzbuzz.Config]int{}}
+}
+
+// increment increments cfg n times.
+func (c *counter) increment(t *testing.T, cfg fizzbuzz.Config, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		if err := c.s.Increment(cfg); err != nil {
+			t.Fatalf("Increment(%+v): %v", cfg, err)
+		}
+	}
+	c.want[cfg] += n
+}
+
+// top returns the n expected first entries selected by f.
+func (c *counter) top(n int, f stats.Filter) []stats.Entry {
+	var entries []stats.Entry
+	for cfg, count := range c.want {
+		if f.Match(cfg) {
+			entries = append(entries, stats.Entry{Count: count, Config: cfg})
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Count != entries[j].Count {
+			return entries[i].Count > entries[j].Count
+		}
+		return less(entries[i].Config, entries[j].Config)
+	})
+	if len(entries) > n {
+		entries = entries[:n]
+	}
+	return entries
+}
+
+// check checks the results of MostFrequent, MostFrequentIn on the current hits and TopN with f.
+func (c *counter) check(t *testing.T, f stats.Filter) {
+	t.Helper()
+	var wantCount int
+	var wantCfg fizzbuzz.Config
+	if top := c.top(1, stats.Filter{}); len(top) > 0 {
+		wantCount, wantCfg = top[0].Count, top[0].Config
+	}
+	assertMostFrequent(t, "MostFrequent", c.s.MostFrequent, wantCount, wantCfg)
+	assertMostFrequent(t, "MostFrequentIn(the last hour)", func() (int, fizzbuzz.Config, error) {
+		return c.s.MostFrequentIn(stats.Window{Since: time.Now().Add(-time.Hour)})
+	}, wantCount, wantCfg)
+	for _, n := range []int{1, 3, len(c.want) + 1} {
+		assertTop(t, c.s, n, f, c.top(n, f))
+	}
+}
+
+func assertMostFrequent(t *testing.T, descr string, mostFrequent func() (int, fizzbuzz.Config, error), wantCount int, wantCfg fizzbuzz.Config) {
+	t.Helper()
+	count, cfg, err := mostFrequent()
+	if err != nil {
+		t.Fatalf("%s: %v", descr, err)
+	}
+	if count != wantCount || cfg != wantCfg {
+		t.Fatalf("%s: got %d %+v, want %d %+v", descr, count, cfg, wantCount, wantCfg)
+	}
+}
+
+func assertTop(t *testing.T, s stats.Service, n int, f stats.Filter, want []stats.Entry) {
+	t.Helper()
+	got, err := s.TopN(n, f)
+	if err != nil {
+		t.Fatalf("TopN(%d, %+v): %v", n, f, err)
+	}
+	// The errors of the approximate services are ignored, the counts must be exact
+	format := func(entries []stats.Entry) string {
+		var b strings.Builder
+		for _, e := range entries {
+			fmt.Fprintf(&b, "\n\t%d %+v", e.Count, e.Config)
+		}
+		return b.String()
+	}
+	if format(got) != format(want) {
+		t.Fatalf("TopN(%d, %+v):\ngot:%s\nwant:%s", n, f, format(got), format(want))
+	}
+}
+
+// testEmpty checks that a service without hits has no most frequent config.
+func testEmpty(t *testing.T, s stats.Service) {
+	c := newCounter(s)
+	c.check(t, stats.Filter{})
+	assertMostFrequent(t, "MostFrequentIn(all the time)", func() (int, fizzbuzz.Config, error) {
+		return s.MostFrequentIn(stats.Window{})
+	}, 0, fizzbuzz.Config{})
+	if err := s.Compact(time.Now(), stats.DefaultRetention); err != nil {
+		t.Fatal("Compact:", err)
+	}
+	c.check(t, stats.Filter{})
+}
+
+// testCounts checks the counts of several configs, and the filters of TopN.
+func testCounts(t *testing.T, s stats.Service) {
+	c := newCounter(s)
+	fizz := fizzbuzz.Default()
+	c.increment(t, fizz, 1)
+	c.check(t, stats.Filter{})
+	for i := 1; i <= 20; i++ {
+		c.increment(t, fizzbuzz.Config{Limit: i, Int1: i % 4, Int2: i % 3, Str1: "fizz", Str2: "buzz"}, i%7+1)
+		c.check(t, stats.Filter{})
+	}
+	c.increment(t, fizz, 10)
+	c.check(t, stats.Filter{})
+
+	minLimit, maxLimit, int1, int2 := 5, 15, 2, 0
+	for _, f := range []stats.Filter{
+		{MinLimit: &minLimit},
+		{MaxLimit: &maxLimit},
+		{MinLimit: &minLimit, MaxLimit: &maxLimit, Int1: &int1},
+		{Int2: &int2},
+		{Str1Prefix: "fi", Str2Prefix: "bu"},
+		{Str1Prefix: "buzz"},
+		{MinLimit: &maxLimit, MaxLimit: &minLimit},
+	} {
+		c.check(t, f)
+	}
+}
+
+// testTieBreak checks that the configs with the same count are ordered by each of their fields.
+func testTieBreak(t *testing.T, s stats.Service) {
+	c := newCounter(s)
+	// From the biggest to the smallest, so that the first ones to be counted aren't the expected ones
+	configs := []fizzbuzz.Config{
+		{Limit: 3, Int1: 1, Int2: 1, Str1: "b", Str2: "b"},
+		{Limit: 2, Int1: 2, Int2: 1, Str1: "b", Str2: "b"},
+		{Limit: 2, Int1: 1, Int2: 2, Str1: "b", Str2: "b"},
+		{Limit: 2, Int1: 1, Int2: 1, Str1: "ba", Str2: "b"},
+		{Limit: 2, Int1: 1, Int2: 1, Str1: "b", Str2: "b"},
+		{Limit: 2, Int1: 1, Int2: 1, Str1: "a", Str2: "b"},
+		{Limit: 2, Int1: 1, Int2: 1, Str1: "a", Str2: "a"},
+		{Limit: 2, Int1: 1, Int2: 1, Str1: "a", Str2: ""},
+		{Limit: -1, Int1: 1, Int2: 1, Str1: "a", Str2: ""},
+	}
+	for _, cfg := range configs {
+		c.increment(t, cfg, 2)
+		c.check(t, stats.Filter{})
+	}
+	// A config that catches up with the leader doesn't take its place, unless it is smaller
+	c.increment(t, configs[0], 1)
+	c.check(t, stats.Filter{})
+	c.increment(t, configs[len(configs)-1], 1)
+	c.check(t, stats.Filter{})
+}
+
+// testUnicode checks that the strings are stored as they are, compared bytewise and filtered by exact prefixes.
+func testUnicode(t *testing.T, s stats.Service) {
+	c := newCounter(s)
+	for i, str := range []string{
+		"z",
+		"\u00e9",  // precomposed, after "z" bytewise
+		"e\u0301", // decomposed, the same text but a different string
+		"🍕",       // outside of the basic multilingual plane
+		"日本語",
+		"50%",
+		"500",
+		"a_b",
+		"axb",
+		"A_B",
+		`back\slash`,
+		"with space ",
+		"",
+	} {
+		c.increment(t, fizzbuzz.Config{Limit: 100, Int1: 3, Int2: 5, Str1: str, Str2: "🍕" + str}, 1+i%3)
+	}
+	c.check(t, stats.Filter{})
+	for _, prefix := range []string{"e", "\u00e9", "🍕", "日本", "50%", "a_", "A", `back\`, "with space"} {
+		c.check(t, stats.Filter{Str1Prefix: prefix})
+		c.check(t, stats.Filter{Str2Prefix: "🍕" + prefix})
+	}
+}
+
+// testWindow checks that the hits are counted in the time windows around them, before and after compaction.
+func testWindow(t *testing.T, s stats.Service) {
+	c := newCounter(s)
+	a := fizzbuzz.Config{Limit: 1}
+	b := fizzbuzz.Config{Limit: 2}
+	c.increment(t, b, 2)
+	c.increment(t, a, 2)
+	c.increment(t, b, 1)
+
+	now := time.Now()
+	for _, step := range []struct {
+		name   string
+		now    time.Time
+		recent bool // whether the hits are still in the buckets
+	}{
+		{"before compaction", now, true},
+		{"after compaction in hours", now.Add(3 * time.Hour), true},
+		{"after compaction in days", now.Add(50 * time.Hour), true},
+		{"after retention", now.Add(100 * 24 * time.Hour), false},
+	} {
+		if err := s.Compact(step.now, stats.DefaultRetention); err != nil {
+			t.Fatal("Compact:", err)
+		}
+		wantCount, wantCfg := 0, fizzbuzz.Config{}
+		if step.recent {
+			wantCount, wantCfg = 3, b
+		}
+		for _, w := range []struct {
+			window stats.Window
+			in     bool // whether the hits are in the window
+		}{
+			{stats.Window{}, true},
+			{stats.Window{Since: now.Add(-24 * time.Hour)}, true},
+			{stats.Window{Since: now.Add(-24 * time.Hour), Until: now.Add(time.Hour)}, true},
+			{stats.Window{Until: now.Add(-24 * time.Hour)}, false},
+			{stats.Window{Since: now.Add(time.Hour)}, false},
+		} {
+			descr := fmt.Sprintf("MostFrequentIn(%+v) %s", w.window, step.name)
+			if w.in {
+				assertMostFrequent(t, descr, func() (int, fizzbuzz.Config, error) {
+					return s.MostFrequentIn(w.window)
+				}, wantCount, wantCfg)
+			} else {
+				assertMostFrequent(t, descr, func() (int, fizzbuzz.Config, error) {
+					return s.MostFrequentIn(w.window)
+				}, 0, fizzbuzz.Config{})
+			}
+		}
+		// The lifetime counts are never affected
+		assertMostFrequent(t, "MostFrequent "+step.name, s.MostFrequent, 3, b)
+		assertTop(t, s, 10, stats.Filter{}, c.top(10, stats.Filter{}))
+	}
+}
+
+// testConcurrency checks that the concurrent increments are all counted, while the stats are read and compacted.
+func testConcurrency(t *testing.T, s stats.Service) {
+	const (
+		writers    = 8
+		increments = 100
+	)
+	configs := []fizzbuzz.Config{{Limit: 1}, {Limit: 2}, {Limit: 3, Str1: "🍕"}, {Limit: 4}}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, writers+1)
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < increments; j++ {
+				if err := s.Increment(configs[(i+j)%len(configs)]); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(i)
+	}
+	done := make(chan struct{})
+	readerDone := make(chan struct{})
+	go func() {
+		defer close(readerDone)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			_, _, err := s.MostFrequent()
+			if err == nil {
+				_, _, err = s.MostFrequentIn(stats.Window{Since: time.Now().Add(-time.Hour)})
+			}
+			if err == nil {
+				_, err = s.TopN(2, stats.Filter{})
+			}
+			if err == nil {
+				err = s.Compact(time.Now(), stats.DefaultRetention)
+			}
+			if err != nil {
+				errs <- err
+				return
+			}
+		}
+	}()
+	wg.Wait()
+	close(done)
+	<-readerDone
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	c := newCounter(s)
+	for _, cfg := range configs {
+		c.want[cfg] = writers * increments / len(configs)
+	}
+	c.check(t, stats.Filter{})
+}
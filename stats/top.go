@@ -0,0 +1,60 @@
+package stats
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/xpetit/fizzbuzz/v5"
+)
+
+// Filter restricts the configs of a TopN query, its zero value matching all of them.
+type Filter struct {
+	MinLimit, MaxLimit *int // MinLimit and MaxLimit, if not nil, are the bounds (included) of the limit
+	Int1, Int2         *int // Int1 and Int2, if not nil, are the divisors
+	Str1Prefix         string
+	Str2Prefix         string
+}
+
+// Match reports whether cfg is selected by the filter.
+func (f Filter) Match(cfg fizzbuzz.Config) bool {
+	return (f.MinLimit == nil || cfg.Limit >= *f.MinLimit) &&
+		(f.MaxLimit == nil || cfg.Limit <= *f.MaxLimit) &&
+		(f.Int1 == nil || cfg.Int1 == *f.Int1) &&
+		(f.Int2 == nil || cfg.Int2 == *f.Int2) &&
+		strings.HasPrefix(cfg.Str1, f.Str1Prefix) &&
+		strings.HasPrefix(cfg.Str2, f.Str2Prefix)
+}
+
+// Entry is a config with its hit count.
+type Entry struct {
+	Count  int             `json:"count"`
+	Config fizzbuzz.Config `json:"config"`
+	Error  int             `json:"error,omitempty"` // Error is the maximum overestimation of Count, by the approximate services
+}
+
+// before reports whether a is ranked before b: the most frequent first, then the smallest config.
+func before(a, b Entry) bool {
+	if a.Count != b.Count {
+		return a.Count > b.Count
+	}
+	return smaller(a.Config, b.Config)
+}
+
+// sortTop sorts the entries by rank and keeps the n first ones.
+func sortTop(entries []Entry, n int) []Entry {
+	sort.Slice(entries, func(i, j int) bool { return before(entries[i], entries[j]) })
+	if len(entries) > n {
+		entries = entries[:n]
+	}
+	return entries
+}
+
+// appendMatches appends the entries of m selected by f.
+func appendMatches(entries []Entry, m map[fizzbuzz.Config]int, f Filter) []Entry {
+	for cfg, count := range m {
+		if f.Match(cfg) {
+			entries = append(entries, Entry{Count: count, Config: cfg})
+		}
+	}
+	return entries
+}
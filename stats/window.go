@@ -0,0 +1,176 @@
+package stats
+
+import (
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/xpetit/fizzbuzz/v5"
+)
+
+// Window is a time range of hits, from Since (included) to Until (excluded), a zero time meaning no bound.
+//
+// The hits are counted in buckets of a minute, an hour or a day (see Retention),
+// and a bucket belongs to the window if it starts in it.
+type Window struct {
+	Since, Until time.Time
+}
+
+// bounds returns the range of bucket starts of the window, in Unix seconds: [since, until).
+func (w Window) bounds() (since, until int64) {
+	since, until = math.MinInt64, math.MaxInt64
+	if !w.Since.IsZero() {
+		since = w.Since.Unix()
+		if w.Since.Nanosecond() > 0 {
+			since++ // a bucket starting before Since isn't in the window
+		}
+	}
+	if !w.Until.IsZero() {
+		until = w.Until.Unix()
+		if w.Until.Nanosecond() > 0 {
+			until++ // a bucket starting in the same second as Until, before it, is in the window
+		}
+	}
+	return
+}
+
+// Retention tells how long the hits are kept in buckets: in minute buckets for Minutes,
+// then compacted in hour buckets kept for Hours, then compacted in day buckets kept for Days.
+// The durations are counted from the end of the buckets. The lifetime hit count is never affected.
+type Retention struct {
+	Minutes, Hours, Days time.Duration
+}
+
+// DefaultRetention keeps the minute buckets for 2 hours, the hour buckets for 2 days and the day buckets for 90 days.
+var DefaultRetention = Retention{
+	Minutes: 2 * time.Hour,
+	Hours:   48 * time.Hour,
+	Days:    90 * 24 * time.Hour,
+}
+
+// The sizes of the buckets, in seconds
+const (
+	minute = 60
+	hour   = 60 * minute
+	day    = 24 * hour
+)
+
+// minuteOf returns the start of the minute bucket of t, in Unix seconds.
+func minuteOf(t time.Time) int64 {
+	s := t.Unix()
+	return s - s%minute
+}
+
+// clock holds the current minute bucket, updated every second by a goroutine started on first use,
+// so that the in-memory increments don't call time.Now.
+var clock struct {
+	start  sync.Once
+	minute atomic.Int64
+}
+
+// currentMinute returns the start of the current minute bucket, in Unix seconds, late by a second at most.
+func currentMinute() int64 {
+	clock.start.Do(func() {
+		clock.minute.Store(minuteOf(time.Now()))
+		go func() {
+			for now := range time.Tick(time.Second) {
+				clock.minute.Store(minuteOf(now))
+			}
+		}()
+	})
+	return clock.minute.Load()
+}
+
+// stage is a step of the compaction: the buckets smaller than size and ending before cutoff (Unix seconds)
+// are merged into buckets of the given size, or dropped if size is 0.
+type stage struct {
+	size   int64
+	cutoff int64
+}
+
+// stages returns the steps of the compaction at time now, to be run in order.
+func (r Retention) stages(now time.Time) []stage {
+	s := now.Unix()
+	return []stage{
+		{hour, s - int64(r.Minutes/time.Second)},
+		{day, s - int64(r.Hours/time.Second)},
+		{0, s - int64(r.Days/time.Second)},
+	}
+}
+
+// bucket identifies a bucket by its start and size, in seconds.
+type bucket struct {
+	start, size int64
+}
+
+// hit identifies the hits of a config in a minute bucket.
+type hit struct {
+	minute int64
+	cfg    fizzbuzz.Config
+}
+
+// buckets holds the hit counts of the configs in each bucket.
+type buckets map[bucket]map[fizzbuzz.Config]int
+
+func (b buckets) add(key bucket, cfg fizzbuzz.Config, count int) {
+	m := b[key]
+	if m == nil {
+		m = map[fizzbuzz.Config]int{}
+		b[key] = m
+	}
+	m[cfg] += count
+}
+
+// compact merges the old buckets into bigger ones and drops the oldest ones, according to r.
+func (b buckets) compact(now time.Time, r Retention) {
+	b.compactFunc(now, r, nil)
+}
+
+// compactFunc is like compact, calling removed (if not nil) with each bucket removed, its hits,
+// and the bucket they are merged into (the zero bucket if they are dropped).
+func (b buckets) compactFunc(now time.Time, r Retention, removed func(key bucket, hits map[fizzbuzz.Config]int, into bucket)) {
+	for _, st := range r.stages(now) {
+		for key, m := range b {
+			if st.size != 0 && key.size >= st.size || key.start+key.size > st.cutoff {
+				continue
+			}
+			delete(b, key)
+			var into bucket
+			if st.size != 0 {
+				// The merged buckets have the size of the stage, so they aren't visited again by this loop
+				into = bucket{key.start - key.start%st.size, st.size}
+				for cfg, count := range m {
+					b.add(into, cfg, count)
+				}
+			}
+			if removed != nil {
+				removed(key, m, into)
+			}
+		}
+	}
+}
+
+// addCounts adds the hit counts of the buckets in the window to counts.
+func (b buckets) addCounts(counts map[fizzbuzz.Config]int, w Window) {
+	since, until := w.bounds()
+	for key, m := range b {
+		if key.start < since || key.start >= until {
+			continue
+		}
+		for cfg, count := range m {
+			counts[cfg] += count
+		}
+	}
+}
+
+// mostFrequentOf returns the most frequent config of counts, the smallest one in case of equality.
+func mostFrequentOf(counts map[fizzbuzz.Config]int) (count int, cfg fizzbuzz.Config) {
+	for config, c := range counts {
+		if c > count || c == count && smaller(config, cfg) {
+			count = c
+			cfg = config
+		}
+	}
+	return
+}
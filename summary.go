@@ -0,0 +1,42 @@
+package fizzbuzz
+
+import "math/big"
+
+// Counts holds the number of Fizz buzz values of each kind, and the size of their JSON output.
+type Counts struct {
+	Number int      `json:"number"` // Number is the number of values that are numbers
+	Int1   int      `json:"int1"`   // Int1 is the number of values only divisible by Int1
+	Int2   int      `json:"int2"`   // Int2 is the number of values only divisible by Int2
+	Both   int      `json:"both"`   // Both is the number of values divisible by Int1 and Int2
+	Bytes  *big.Int `json:"bytes"`  // Bytes is the size of the output of WriteTo, which can exceed math.MaxInt64
+}
+
+// Summary returns the counts of the Fizz buzz values, computed arithmetically without generating them.
+// Its complexity is O(log Limit).
+//
+// Attempting to summarize a Fizz buzz with negative or zero divisors causes Summary to return an ErrInvalidInput.
+func Summary(c Config) (Counts, error) {
+	if err := c.validate(); err != nil {
+		return Counts{}, err
+	}
+	n := c.Limit
+	if n < 1 {
+		return Counts{Bytes: big.NewInt(int64(len(empty)))}, nil
+	}
+
+	var counts Counts
+	if l := lcm(c.Int1, c.Int2, n); l != 0 {
+		counts.Both = n / l
+	}
+	counts.Int1 = n/c.Int1 - counts.Both
+	counts.Int2 = n/c.Int2 - counts.Both
+	counts.Number = n - counts.Int1 - counts.Int2 - counts.Both
+
+	rc := c.Rules()
+	lens := []int{len(marshalJSON(c.Str1)) - 2, len(marshalJSON(c.Str2)) - 2}
+	size := rc.valuesSize(lens, plainDivisors(rc.Rules), 1, n)
+	size.add(2, 1) // the opening bracket and the newline, the last comma being replaced by the closing bracket
+	counts.Bytes = size.big()
+
+	return counts, nil
+}
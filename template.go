@@ -0,0 +1,122 @@
+package fizzbuzz
+
+import "strconv"
+
+const (
+	// maxPeriod is the largest period (in number of values) for which a template is built
+	maxPeriod = 1 << 16
+
+	// maxTemplateSize is the largest size (in bytes) of the fixed parts of a template
+	maxTemplateSize = 1 << 16
+)
+
+// counter is a positive decimal number stored as ASCII digits, so that it can be incremented without formatting it again.
+type counter struct {
+	digits []byte
+	n      int
+}
+
+// set sets the counter to n.
+func (c *counter) set(n int) {
+	c.n = n
+	c.digits = strconv.AppendInt(c.digits[:0], int64(n), 10)
+}
+
+// add adds d (positive) to the counter, digit by digit, starting from the least significant one.
+func (c *counter) add(d int) {
+	c.n += d
+	for i := len(c.digits) - 1; d > 0; i-- {
+		if i < 0 {
+			// The number has one more digit, insert a zero in front of it
+			c.digits = append(c.digits, 0)
+			copy(c.digits[1:], c.digits)
+			c.digits[0] = '0'
+			i = 0
+		}
+		digit := int(c.digits[i]-'0') + d%10
+		d /= 10
+		if digit > 9 {
+			digit -= 10
+			d++ // carry
+		}
+		c.digits[i] = '0' + byte(digit)
+	}
+}
+
+// segment is a part of a template: fixed bytes followed by a number.
+type segment struct {
+	end int // end is the index in template.fixed of the end of the fixed bytes of the segment
+	pos int // pos is the position in the period (1 being the first) of the number following the fixed bytes, 0 if there is none
+}
+
+// template is the JSON output of one period of a Fizz buzz, each value being followed by a comma.
+// Only the numbers not replaced by a rule change from one period to another, so they are left as slots to fill.
+type template struct {
+	fixed    []byte    // fixed holds the bytes that are copied as is, for all segments
+	segments []segment // segments splits fixed around the slots of the numbers
+	period   int
+}
+
+// lcm returns the least common multiple of a and b (strictly positive), or 0 if it is greater than bound.
+func lcm(a, b, bound int) int {
+	x, y := a, b
+	for y != 0 {
+		x, y = y, x%y
+	}
+	// a*b/x is the LCM, check for overflow before multiplying
+	m := b / x
+	if a > bound/m {
+		return 0
+	}
+	return a * m
+}
+
+// newTemplate returns the template of the rules, strs being their JSON-encoded strings without quotes.
+// It returns nil if the period is too large to be cached or if there are not enough values to write to reuse it.
+func newTemplate(rules []Rule, strs [][]byte, limit int) *template {
+	period := 1
+	for _, r := range rules {
+		if period = lcm(period, r.Divisor, maxPeriod); period == 0 {
+			return nil
+		}
+	}
+	if period > limit/2 {
+		return nil
+	}
+
+	t := &template{period: period}
+	for i := 1; i <= period; i++ {
+		t.fixed = append(t.fixed, '"')
+		matched := false
+		for j, r := range rules {
+			if i%r.Divisor == 0 {
+				t.fixed = append(t.fixed, strs[j]...)
+				matched = true
+			}
+		}
+		if !matched {
+			// Leave a slot for the number i
+			t.segments = append(t.segments, segment{end: len(t.fixed), pos: i})
+		}
+		t.fixed = append(t.fixed, '"', ',')
+		if len(t.fixed) > maxTemplateSize {
+			return nil
+		}
+	}
+	t.segments = append(t.segments, segment{end: len(t.fixed)})
+	return t
+}
+
+// appendPeriod appends to buf the period starting after base (base+1 being the first value), using num to format the numbers.
+func (t *template) appendPeriod(buf []byte, num *counter, base int) []byte {
+	start := 0
+	for _, s := range t.segments {
+		buf = append(buf, t.fixed[start:s.end]...)
+		start = s.end
+		if s.pos > 0 {
+			num.add(base + s.pos - num.n)
+			buf = append(buf, num.digits...)
+		}
+	}
+	return buf
+}